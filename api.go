@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/writeas/go-writeas/v2"
@@ -15,10 +17,10 @@ import (
 // and any error (in user-friendly form) that occurs. See
 // https://developers.write.as/docs/api/#retrieve-collection-posts
 // The page parameter is 1-based. Once the pages are exhausted, the returned slice will be empty.
-func GetCollectionPostsPaginated(client *writeas.Client, alias string, page uint64) (*[]writeas.Post, error) {
+func GetCollectionPostsPaginated(ctx context.Context, client *writeas.Client, alias string, page uint64) (*[]writeas.Post, error) {
 	metaDataEditUrl := client.BaseURL() + fmt.Sprintf("/collections/%s/posts?page=%d", alias, page)
 
-	req, err := http.NewRequest("GET", metaDataEditUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", metaDataEditUrl, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -43,13 +45,58 @@ func GetCollectionPostsPaginated(client *writeas.Client, alias string, page uint
 
 		return coll.Posts, nil
 	} else if status == http.StatusNotFound {
-		return nil, fmt.Errorf("Collection not found.")
+		return nil, NewHttpStatusError(response, "Collection not found.")
 	} else {
-		return nil, fmt.Errorf("Problem getting collection: %d. %v\n", status, err)
+		return nil, NewHttpStatusError(response, "Problem getting collection")
 	}
 }
 
-func SetPostCtime(client *writeas.Client, newPost writeas.Post, collAlias, title string, ctime time.Time) error {
+// CollectPost moves an existing post owned by the user into the collection. See
+// https://developers.write.as/docs/api/#move-a-post-to-a-collection
+func CollectPost(ctx context.Context, client *writeas.Client, collAlias string, postID string) (*writeas.Post, error) {
+	body, err := json.Marshal([]writeas.OwnedPostParams{{ID: postID}})
+	if err != nil {
+		return nil, err
+	}
+
+	collectUrl := client.BaseURL() + "/collections/" + collAlias + "/collect"
+	req, err := http.NewRequestWithContext(ctx, "POST", collectUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Token "+client.Token())
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, NewHttpStatusError(response, fmt.Sprintf("failed to move the post %s into the collection", postID))
+	}
+
+	var results []writeas.ClaimPostResult
+	env := &impart.Envelope{
+		Data: &results,
+	}
+	err = json.NewDecoder(response.Body).Decode(&env)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(results) != 1 {
+		return nil, fmt.Errorf("unexpected response when moving the post %s into the collection", postID)
+	}
+	if results[0].Code != http.StatusOK || results[0].Post == nil {
+		return nil, fmt.Errorf("failed to move the post %s into the collection: %s", postID, results[0].ErrorMessage)
+	}
+
+	return results[0].Post, nil
+}
+
+func SetPostCtime(ctx context.Context, client *writeas.Client, newPost writeas.Post, collAlias, title string, ctime time.Time) error {
 	data := make(url.Values)
 	data["slug"] = []string{newPost.Slug}
 	data["title"] = []string{title}
@@ -58,7 +105,7 @@ func SetPostCtime(client *writeas.Client, newPost writeas.Post, collAlias, title
 	// The JSON API appears to be broken, it can't be used to set the post's mtime or ctime. So emulate the UI access.
 	metaDataEditUrl := client.BaseURL() + "/collections/" + collAlias + "/posts/" + newPost.ID
 
-	req, err := http.NewRequest("POST", metaDataEditUrl, strings.NewReader(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", metaDataEditUrl, strings.NewReader(data.Encode()))
 	if err != nil {
 		return err
 	}
@@ -72,7 +119,7 @@ func SetPostCtime(client *writeas.Client, newPost writeas.Post, collAlias, title
 	defer func() { _ = response.Body.Close() }()
 
 	if response.StatusCode != http.StatusFound && response.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to update the ctime for %s, status=%s", newPost.Slug, response.Status)
+		return NewHttpStatusError(response, fmt.Sprintf("failed to update the ctime for %s", newPost.Slug))
 	}
 
 	return nil
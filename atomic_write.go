@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WriteFileAtomically writes the file into a temporary file in the same directory, syncs it, and then renames
+// it into place. So the file is always either the old or the new complete version, even if the process crashes
+// or the write fails midway. The mtime is set before the rename (which preserves it), unless it's zero.
+func WriteFileAtomically(fileName string, perm os.FileMode, mtime time.Time, write func(w io.Writer) error) error {
+	dir := filepath.Dir(fileName)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is hidden, so it's never picked up as a post
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	renamed := false
+	defer func() {
+		_ = tmp.Close()
+		if !renamed {
+			_ = os.Remove(tmpName)
+		}
+	}()
+
+	err = write(tmp)
+	if err != nil {
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmp.Chmod(perm)
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if !mtime.IsZero() {
+		err = os.Chtimes(tmpName, time.Time{}, mtime)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(tmpName, fileName)
+	if err != nil {
+		return err
+	}
+	renamed = true
+
+	// Make the rename itself durable, not all platforms support syncing the directories
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "sub", "post.md")
+	mtime := time.Date(2024, 1, 2, 8, 30, 0, 0, time.UTC)
+
+	for _, content := range []string{"old\n", "new\n"} {
+		err := WriteFileAtomically(fileName, 0600, mtime, func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(fileName)
+		if err != nil || string(data) != content {
+			t.Errorf("unexpected content: %q, %v", data, err)
+		}
+	}
+
+	st, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("unexpected permissions: %v", st.Mode().Perm())
+	}
+	if !st.ModTime().Equal(mtime) {
+		t.Errorf("unexpected mtime: %v", st.ModTime())
+	}
+
+	// The zero mtime keeps the current time
+	err = WriteFileAtomically(fileName, 0644, time.Time{}, func(w io.Writer) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(st.ModTime()) > time.Minute || st.Mode().Perm() != 0644 {
+		t.Errorf("unexpected mtime or permissions: %v, %v", st.ModTime(), st.Mode().Perm())
+	}
+}
+
+func TestWriteFileAtomicallyFailure(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "post.md")
+	err := os.WriteFile(fileName, []byte("old\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errFailed := errors.New("failed")
+	err = WriteFileAtomically(fileName, 0644, time.Time{}, func(w io.Writer) error {
+		_, _ = io.WriteString(w, "partial")
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("the write error is not returned: %v", err)
+	}
+
+	// The old version is intact, and the temporary file is removed
+	data, err := os.ReadFile(fileName)
+	if err != nil || string(data) != "old\n" {
+		t.Errorf("the file is changed: %q, %v", data, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("the temporary file is left behind: %v", entries)
+	}
+}
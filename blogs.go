@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// BlogSettings describes a single blog: its Write.As collection, the local directory and the image hosting
+type BlogSettings struct {
+	Alias         string `yaml:"alias"`
+	RootDirectory string `yaml:"root"`
+
+	ImageHostingType string `yaml:"image-hosting-type,omitempty"`
+	ImageLogin       string `yaml:"image-login,omitempty"`
+	ImagePassword    string `yaml:"image-password,omitempty"`
+
+	SnapAsAlbum string `yaml:"snapas-album,omitempty"`
+
+	WebDavEndpoint string `yaml:"webdav-endpoint,omitempty"`
+	WebDavImageUrl string `yaml:"webdav-published-url,omitempty"`
+
+	S3Endpoint  string `yaml:"s3-endpoint,omitempty"`
+	S3Bucket    string `yaml:"s3-bucket,omitempty"`
+	S3Prefix    string `yaml:"s3-prefix,omitempty"`
+	S3Region    string `yaml:"s3-region,omitempty"`
+	S3PathStyle bool   `yaml:"s3-path-style,omitempty"`
+	S3ImageUrl  string `yaml:"s3-published-url,omitempty"`
+	S3AccessKey string `yaml:"s3-access-key,omitempty"`
+	S3SecretKey string `yaml:"s3-secret-key,omitempty"`
+
+	FsImageDir string `yaml:"fs-image-dir,omitempty"`
+	FsImageUrl string `yaml:"fs-published-url,omitempty"`
+}
+
+// BlogsConfig is the file that lists the blogs to synchronize in a single run
+type BlogsConfig struct {
+	Blogs []BlogSettings `yaml:"blogs"`
+}
+
+// LoadBlogsConfig reads the list of the blogs. The relative root directories are resolved against the
+// directory of the file.
+func LoadBlogsConfig(fileName string) ([]BlogSettings, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf BlogsConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(&conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", fileName, err)
+	}
+	if len(conf.Blogs) == 0 {
+		return nil, fmt.Errorf("no blogs are listed in %s", fileName)
+	}
+
+	return resolveBlogRoots(conf.Blogs, filepath.Dir(fileName))
+}
+
+// resolveBlogRoots makes the blog roots (and the other directories) absolute, relative to the directory
+// of the file that lists them
+func resolveBlogRoots(blogs []BlogSettings, baseDir string) ([]BlogSettings, error) {
+	for i := range blogs {
+		for _, dir := range []*string{&blogs[i].RootDirectory, &blogs[i].FsImageDir} {
+			resolved, err := expandHome(*dir)
+			if err != nil {
+				return nil, err
+			}
+			if resolved != "" && !filepath.IsAbs(resolved) {
+				resolved = filepath.Join(baseDir, resolved)
+			}
+			*dir = resolved
+		}
+	}
+	return blogs, nil
+}
+
+// expandHome replaces the leading `~` with the home directory, the shell doesn't do that for the config files
+func expandHome(fileName string) (string, error) {
+	if fileName != "~" && !strings.HasPrefix(fileName, "~/") {
+		return fileName, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, strings.TrimPrefix(fileName, "~")), nil
+}
+
+// withDefaults fills the settings that are not specified for the blog from the global settings
+func (b BlogSettings) withDefaults(sets *Settings) BlogSettings {
+	if b.ImageHostingType == "" {
+		b.ImageHostingType = sets.ImageHostingType
+	}
+	if b.ImageLogin == "" {
+		b.ImageLogin = sets.ImageLogin
+	}
+	if b.ImagePassword == "" {
+		b.ImagePassword = sets.ImagePassword
+	}
+	if b.SnapAsAlbum == "" {
+		b.SnapAsAlbum = sets.SnapAsAlbum
+	}
+	if b.WebDavEndpoint == "" {
+		b.WebDavEndpoint = sets.WebDavEndpoint
+	}
+	if b.WebDavImageUrl == "" {
+		b.WebDavImageUrl = sets.WebDavImageUrl
+	}
+	if b.S3Endpoint == "" {
+		b.S3Endpoint = sets.S3Endpoint
+	}
+	if b.S3Bucket == "" {
+		b.S3Bucket = sets.S3Bucket
+	}
+	if b.S3Prefix == "" {
+		b.S3Prefix = sets.S3Prefix
+	}
+	if b.S3Region == "" {
+		b.S3Region = sets.S3Region
+	}
+	b.S3PathStyle = b.S3PathStyle || sets.S3PathStyle
+	if b.S3ImageUrl == "" {
+		b.S3ImageUrl = sets.S3ImageUrl
+	}
+	if b.S3AccessKey == "" {
+		b.S3AccessKey = sets.S3AccessKey
+	}
+	if b.S3SecretKey == "" {
+		b.S3SecretKey = sets.S3SecretKey
+	}
+	if b.FsImageDir == "" {
+		b.FsImageDir = sets.FsImageDir
+	}
+	if b.FsImageUrl == "" {
+		b.FsImageUrl = sets.FsImageUrl
+	}
+	return b
+}
+
+func (b BlogSettings) validate() error {
+	if b.Alias == "" {
+		return fmt.Errorf("the blog alias is not specified")
+	}
+	if b.RootDirectory == "" {
+		return fmt.Errorf("the root directory of %s is not specified", b.Alias)
+	}
+	switch b.ImageHostingType {
+	case "snapas":
+	case "webdav":
+		if b.WebDavEndpoint == "" || b.WebDavImageUrl == "" {
+			return fmt.Errorf("the WebDAV endpoint and the published URL of %s must be specified", b.Alias)
+		}
+	case "s3":
+		if b.S3Endpoint == "" || b.S3Bucket == "" || b.S3ImageUrl == "" {
+			return fmt.Errorf("the S3 endpoint, the bucket and the published URL of %s must be specified", b.Alias)
+		}
+	case "filesystem":
+		if b.FsImageDir == "" || b.FsImageUrl == "" {
+			return fmt.Errorf("the image directory and the published URL of %s must be specified", b.Alias)
+		}
+	default:
+		return fmt.Errorf("invalid image hosting type of %s: %s", b.Alias, b.ImageHostingType)
+	}
+	return nil
+}
+
+// ResolveBlogs produces the list of the blogs to synchronize: either from the blogs file, or from the
+// configuration file, or the single blog specified by the command line flags.
+func (s *Settings) ResolveBlogs() ([]BlogSettings, error) {
+	blogs := []BlogSettings{s.BlogSettings}
+	if len(s.Blogs) != 0 {
+		blogs = slices.Clone(s.Blogs)
+	}
+	if s.BlogsFile != "" {
+		var err error
+		blogs, err = LoadBlogsConfig(s.BlogsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var res []BlogSettings
+	aliases := make(map[string]bool)
+	roots := make(map[string]bool)
+	for _, b := range blogs {
+		b = b.withDefaults(s)
+		err := b.validate()
+		if err != nil {
+			return nil, err
+		}
+
+		root := filepath.Clean(b.RootDirectory)
+		if aliases[b.Alias] || roots[root] {
+			return nil, fmt.Errorf("the blog %s (%s) is listed more than once", b.Alias, root)
+		}
+		aliases[b.Alias] = true
+		roots[root] = true
+
+		res = append(res, b)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// ConfigFileName is the per-blog configuration file, it's looked up in the blog root
+const ConfigFileName = ".writeas-sync.yaml"
+
+// secretSettings are masked when the configuration is printed
+var secretSettings = map[string]bool{"password": true, "image-password": true, "token": true,
+	"s3-access-key": true, "s3-secret-key": true}
+
+// pathSettings are resolved relative to the directory of the configuration file
+var pathSettings = map[string]bool{"root": true, "blogs": true, "fs-image-dir": true}
+
+// legacyEnvVars predate the WRITEAS_<SETTING> naming, they are still supported
+var legacyEnvVars = map[string]string{
+	"password":        "WRITEAS_PASS",
+	"webdav-endpoint": "WRITEAS_WEBDAV_URL",
+}
+
+// ConfigFile is a parsed configuration file, its keys are the names of the command line flags
+type ConfigFile struct {
+	fileName string
+	values   map[string]*yaml.Node
+}
+
+// configDir is the user-wide configuration directory: $XDG_CONFIG_HOME/writeas-sync
+func configDir() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "writeas-sync")
+}
+
+// GlobalConfigPath is the user-wide configuration file: $XDG_CONFIG_HOME/writeas-sync/config.yaml
+func GlobalConfigPath() string {
+	return filepath.Join(configDir(), "config.yaml")
+}
+
+// EnvVarName is the environment variable for the setting, e.g. WRITEAS_IMAGE_HOSTING_TYPE for --image-hosting-type
+func EnvVarName(setting string) string {
+	return "WRITEAS_" + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+func lookupEnv(setting string) (string, string, bool) {
+	if name, ok := legacyEnvVars[setting]; ok {
+		if val, ok := os.LookupEnv(name); ok {
+			return name, val, true
+		}
+	}
+	name := EnvVarName(setting)
+	val, ok := os.LookupEnv(name)
+	return name, val, ok
+}
+
+// LoadConfigFile reads the configuration file, it returns nil if the file doesn't exist
+func LoadConfigFile(fileName string) (*ConfigFile, error) {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ConfigFile{fileName: fileName, values: make(map[string]*yaml.Node)}
+
+	doc := &yaml.Node{}
+	err = yaml.Unmarshal(data, doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", fileName, err)
+	}
+	if doc.Kind == 0 {
+		return res, nil
+	}
+	if len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s is not a YAML mapping", fileName)
+	}
+
+	mapping := doc.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		res.values[mapping.Content[i].Value] = mapping.Content[i+1]
+	}
+
+	return res, nil
+}
+
+// apply sets the flags that are not yet resolved from the values in the file
+func (c *ConfigFile) apply(flags *pflag.FlagSet, sets *Settings, sources map[string]string,
+	only func(string) bool) error {
+
+	for key, node := range c.values {
+		if !only(key) || sources[key] != "" {
+			continue
+		}
+
+		if key == "blogs" && node.Kind == yaml.SequenceNode {
+			// The blogs are listed inline
+			var blogs []BlogSettings
+			err := node.Decode(&blogs)
+			if err != nil {
+				return fmt.Errorf("failed to parse the blogs in %s: %w", c.fileName, err)
+			}
+			sets.Blogs, err = resolveBlogRoots(blogs, filepath.Dir(c.fileName))
+			if err != nil {
+				return err
+			}
+			sources[key] = c.fileName
+			continue
+		}
+
+		flag := flags.Lookup(key)
+		if flag == nil || key == "help" {
+			return fmt.Errorf("unknown setting in %s: %s", c.fileName, key)
+		}
+
+		var err error
+		switch {
+		case node.Kind == yaml.SequenceNode:
+			var values []string
+			err = node.Decode(&values)
+			if sliceVal, ok := flag.Value.(pflag.SliceValue); ok && err == nil {
+				err = sliceVal.Replace(values)
+			} else if err == nil {
+				err = fmt.Errorf("it's not a list")
+			}
+		case node.Kind == yaml.ScalarNode && pathSettings[key]:
+			var fileName string
+			fileName, err = expandHome(node.Value)
+			if err == nil && fileName != "" && !filepath.IsAbs(fileName) {
+				fileName = filepath.Join(filepath.Dir(c.fileName), fileName)
+			}
+			if err == nil {
+				err = flag.Value.Set(fileName)
+			}
+		case node.Kind == yaml.ScalarNode:
+			err = flag.Value.Set(node.Value)
+		default:
+			err = fmt.Errorf("unsupported value")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value of %s in %s: %w", key, c.fileName, err)
+		}
+		sources[key] = c.fileName
+	}
+
+	return nil
+}
+
+// ResolveConfig fills the settings that are not specified on the command line. The precedence is: the command
+// line flags, then the environment variables, then the .writeas-sync.yaml in the blog root, and finally the
+// global configuration file.
+func ResolveConfig(flags *pflag.FlagSet, sets *Settings) error {
+	sources := make(map[string]string)
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed {
+			sources[flag.Name] = "flag"
+		}
+	})
+
+	var envErr error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		name, val, ok := lookupEnv(flag.Name)
+		if !ok || flag.Name == "help" || sources[flag.Name] != "" || envErr != nil {
+			return
+		}
+		envErr = flag.Value.Set(val)
+		if envErr != nil {
+			envErr = fmt.Errorf("invalid value of %s: %w", name, envErr)
+		}
+		sources[flag.Name] = "env " + name
+	})
+	if envErr != nil {
+		return envErr
+	}
+
+	globalConf, err := LoadConfigFile(GlobalConfigPath())
+	if err != nil {
+		return err
+	}
+	sets.configFiles = []string{GlobalConfigPath()}
+
+	// The global file can specify the blog root, which in turn has its own configuration file
+	isRoot := func(key string) bool { return key == "root" }
+	if globalConf != nil {
+		err = globalConf.apply(flags, sets, sources, isRoot)
+		if err != nil {
+			return err
+		}
+	}
+
+	rootConfPath := filepath.Join(sets.RootDirectory, ConfigFileName)
+	rootConf, err := LoadConfigFile(rootConfPath)
+	if err != nil {
+		return err
+	}
+	sets.configFiles = append(sets.configFiles, rootConfPath)
+	if rootConf != nil {
+		if _, ok := rootConf.values["root"]; ok {
+			return fmt.Errorf("the root directory can't be changed in %s", rootConfPath)
+		}
+	}
+
+	notRoot := func(key string) bool { return key != "root" }
+	for _, conf := range []*ConfigFile{rootConf, globalConf} {
+		if conf == nil {
+			continue
+		}
+		err = conf.apply(flags, sets, sources, notRoot)
+		if err != nil {
+			return err
+		}
+	}
+
+	sets.sources = sources
+	return nil
+}
+
+// PrintConfig writes the effective configuration with the secrets masked
+func PrintConfig(w io.Writer, flags *pflag.FlagSet, sets *Settings) error {
+	for _, fileName := range sets.configFiles {
+		status := "found"
+		if _, err := os.Stat(fileName); err != nil {
+			status = "not found"
+		}
+		_, _ = fmt.Fprintf(w, "# Configuration file: %s (%s)\n", fileName, status)
+	}
+
+	var settings []string
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Name == "help" || (flag.Name == "blogs" && sets.BlogsFile == "") {
+			return
+		}
+
+		value := flag.Value.String()
+		if secretSettings[flag.Name] && value != "" {
+			value = "********"
+		}
+		source := sets.sources[flag.Name]
+		if source == "" {
+			source = "default"
+		}
+		settings = append(settings, fmt.Sprintf("%s: %s  # %s", flag.Name, value, source))
+	})
+	_, _ = fmt.Fprintln(w, strings.Join(settings, "\n"))
+
+	if sets.BlogsFile == "" && len(sets.Blogs) == 0 {
+		return nil
+	}
+
+	blogs, err := sets.ResolveBlogs()
+	if err != nil {
+		return err
+	}
+	for i := range blogs {
+		maskBlogSecrets(&blogs[i])
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err = enc.Encode(BlogsConfig{Blogs: blogs})
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// maskBlogSecrets masks the blog settings that are listed in secretSettings
+func maskBlogSecrets(blog *BlogSettings) {
+	val := reflect.ValueOf(blog).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		name, _, _ := strings.Cut(val.Type().Field(i).Tag.Get("yaml"), ",")
+		field := val.Field(i)
+		if secretSettings[name] && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString("********")
+		}
+	}
+}
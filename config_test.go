@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestMaskBlogSecrets(t *testing.T) {
+	blog := BlogSettings{
+		Alias:         "blog",
+		ImageLogin:    "user",
+		ImagePassword: "password",
+		S3AccessKey:   "access",
+		S3SecretKey:   "secret",
+	}
+	maskBlogSecrets(&blog)
+
+	for name, value := range map[string]string{
+		"image-password": blog.ImagePassword,
+		"s3-access-key":  blog.S3AccessKey,
+		"s3-secret-key":  blog.S3SecretKey,
+	} {
+		if value != "********" {
+			t.Errorf("%s is not masked: %s", name, value)
+		}
+	}
+	if blog.Alias != "blog" || blog.ImageLogin != "user" {
+		t.Errorf("the other settings are changed: %+v", blog)
+	}
+}
+
+// newTestFlags registers a subset of the command line flags, the way main does
+func newTestFlags(sets *Settings, args []string) (*pflag.FlagSet, error) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVarP(&sets.Alias, "alias", "a", "", "")
+	flags.StringVarP(&sets.RootDirectory, "root", "r", ".", "")
+	flags.StringVarP(&sets.Password, "password", "p", "", "")
+	flags.StringVarP(&sets.WebDavEndpoint, "webdav-endpoint", "", "", "")
+	flags.StringVarP(&sets.FsImageDir, "fs-image-dir", "", "", "")
+	flags.StringSliceVarP(&sets.Exclude, "exclude", "", nil, "")
+	flags.IntVarP(&sets.Jobs, "jobs", "j", DefaultJobs, "")
+	return flags, flags.Parse(args)
+}
+
+func TestResolveConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		global   string
+		rootConf string
+		// want maps the settings to their values and sources, $CONFIG and $ROOT are the global configuration
+		// directory and the blog root
+		want    map[string][2]string
+		wantErr bool
+	}{
+		{
+			name:     "flag",
+			args:     []string{"--alias", "flag"},
+			env:      map[string]string{"WRITEAS_ALIAS": "env"},
+			global:   "alias: global\n",
+			rootConf: "alias: blog\n",
+			want:     map[string][2]string{"alias": {"flag", "flag"}},
+		},
+		{
+			name:     "env",
+			env:      map[string]string{"WRITEAS_ALIAS": "env"},
+			global:   "alias: global\n",
+			rootConf: "alias: blog\n",
+			want:     map[string][2]string{"alias": {"env", "env WRITEAS_ALIAS"}},
+		},
+		{
+			name:     "blog root file",
+			global:   "alias: global\njobs: 2\n",
+			rootConf: "alias: blog\n",
+			want: map[string][2]string{
+				"alias": {"blog", "$ROOT/.writeas-sync.yaml"},
+				"jobs":  {"2", "$CONFIG/config.yaml"},
+			},
+		},
+		{
+			name:   "global file",
+			global: "alias: global\nexclude: [drafts, private]\n",
+			want: map[string][2]string{
+				"alias":   {"global", "$CONFIG/config.yaml"},
+				"exclude": {"[drafts,private]", "$CONFIG/config.yaml"},
+			},
+		},
+		{
+			name: "legacy env",
+			env:  map[string]string{"WRITEAS_PASS": "secret", "WRITEAS_WEBDAV_URL": "https://dav.example.com"},
+			want: map[string][2]string{
+				"password":        {"secret", "env WRITEAS_PASS"},
+				"webdav-endpoint": {"https://dav.example.com", "env WRITEAS_WEBDAV_URL"},
+			},
+		},
+		{
+			name:     "relative paths",
+			rootConf: "fs-image-dir: images\n",
+			want:     map[string][2]string{"fs-image-dir": {"$ROOT/images", "$ROOT/.writeas-sync.yaml"}},
+		},
+		{
+			name:     "root in the blog root file",
+			rootConf: "root: /elsewhere\n",
+			wantErr:  true,
+		},
+		{
+			name:    "unknown setting",
+			global:  "colour: blue\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid env",
+			env:     map[string]string{"WRITEAS_JOBS": "many"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configHome := t.TempDir()
+			rootDir := t.TempDir()
+			setTestEnv(t, "XDG_CONFIG_HOME", configHome)
+			for _, name := range []string{"WRITEAS_ALIAS", "WRITEAS_PASS", "WRITEAS_PASSWORD", "WRITEAS_WEBDAV_URL",
+				"WRITEAS_WEBDAV_ENDPOINT", "WRITEAS_FS_IMAGE_DIR", "WRITEAS_EXCLUDE", "WRITEAS_JOBS", "WRITEAS_ROOT"} {
+				setTestEnv(t, name, tt.env[name])
+			}
+			writeTestConfig(t, filepath.Join(configHome, "writeas-sync", "config.yaml"), tt.global)
+			writeTestConfig(t, filepath.Join(rootDir, ConfigFileName), tt.rootConf)
+
+			sets := &Settings{}
+			flags, err := newTestFlags(sets, append([]string{"--root", rootDir}, tt.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ResolveConfig(flags, sets)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			paths := strings.NewReplacer("$CONFIG", filepath.Join(configHome, "writeas-sync"), "$ROOT", rootDir)
+			for name, want := range tt.want {
+				value, source := flags.Lookup(name).Value.String(), sets.sources[name]
+				if value != paths.Replace(want[0]) || source != paths.Replace(want[1]) {
+					t.Errorf("%s = %s (%s), want %s (%s)", name, value, source, want[0], want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestResolveConfigRootFromGlobalFile(t *testing.T) {
+	configHome := t.TempDir()
+	setTestEnv(t, "XDG_CONFIG_HOME", configHome)
+	setTestEnv(t, "WRITEAS_ROOT", "")
+	setTestEnv(t, "WRITEAS_FS_IMAGE_DIR", "")
+	configDir := filepath.Join(configHome, "writeas-sync")
+	writeTestConfig(t, filepath.Join(configDir, "config.yaml"), "root: blog\n")
+	// The blog root set by the global file has its own configuration file
+	writeTestConfig(t, filepath.Join(configDir, "blog", ConfigFileName), "fs-image-dir: images\n")
+
+	sets := &Settings{}
+	flags, err := newTestFlags(sets, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ResolveConfig(flags, sets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sets.RootDirectory != filepath.Join(configDir, "blog") {
+		t.Errorf("the root is not relative to the global file: %s", sets.RootDirectory)
+	}
+	if sets.FsImageDir != filepath.Join(configDir, "blog", "images") {
+		t.Errorf("the blog root file is not applied: %s", sets.FsImageDir)
+	}
+}
+
+// setTestEnv sets the environment variable for the test, the empty value unsets it
+func setTestEnv(t *testing.T, name, value string) {
+	t.Setenv(name, value)
+	if value == "" {
+		_ = os.Unsetenv(name)
+	}
+}
+
+// writeTestConfig writes the configuration file, the empty content means no file
+func writeTestConfig(t *testing.T, fileName, content string) {
+	t.Helper()
+	if content == "" {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(fileName, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
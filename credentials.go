@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CredentialsFileName is the token storage in the global configuration directory
+const CredentialsFileName = "credentials.json"
+
+// TokenStore keeps the Write.As access tokens between the runs, one token per Write.As endpoint
+type TokenStore interface {
+	// Get returns an empty token if there's none
+	Get(endpoint string) (string, error)
+	Store(endpoint, login, token string) error
+	Erase(endpoint string) error
+}
+
+// NewTokenStore uses the credential helper command if it's specified, or the credentials file otherwise
+func NewTokenStore(credentialHelper string) TokenStore {
+	if credentialHelper != "" {
+		return &helperTokenStore{command: credentialHelper}
+	}
+	return &fileTokenStore{fileName: filepath.Join(configDir(), CredentialsFileName)}
+}
+
+type storedToken struct {
+	Login string `json:"login"`
+	Token string `json:"token"`
+}
+
+// fileTokenStore keeps the tokens in a JSON file that is readable only by the user
+type fileTokenStore struct {
+	fileName string
+}
+
+func (f *fileTokenStore) load() (map[string]storedToken, error) {
+	res := make(map[string]storedToken)
+
+	data, err := os.ReadFile(f.fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", f.fileName, err)
+	}
+	return res, nil
+}
+
+func (f *fileTokenStore) save(tokens map[string]storedToken) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(f.fileName), 0700)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(f.fileName, 0600, time.Time{}, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (f *fileTokenStore) Get(endpoint string) (string, error) {
+	tokens, err := f.load()
+	if err != nil {
+		return "", err
+	}
+	return tokens[endpoint].Token, nil
+}
+
+func (f *fileTokenStore) Store(endpoint, login, token string) error {
+	tokens, err := f.load()
+	if err != nil {
+		return err
+	}
+	tokens[endpoint] = storedToken{Login: login, Token: token}
+	return f.save(tokens)
+}
+
+func (f *fileTokenStore) Erase(endpoint string) error {
+	tokens, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[endpoint]; !ok {
+		return nil
+	}
+	delete(tokens, endpoint)
+	return f.save(tokens)
+}
+
+// helperTokenStore delegates the storage to an external command (e.g. a wrapper around the system keychain).
+// The command is invoked with the "get", "store" or "erase" argument and the WRITEAS_ENDPOINT environment
+// variable. The "get" prints the token to the stdout, and the "store" reads it from the stdin.
+type helperTokenStore struct {
+	command string
+}
+
+func (h *helperTokenStore) run(action, endpoint, login, input string) (string, error) {
+	cmd := exec.Command("sh", "-c", h.command+" "+action)
+	cmd.Env = append(os.Environ(), "WRITEAS_ENDPOINT="+endpoint, "WRITEAS_LOGIN="+login)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stderr = os.Stderr
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("credential helper failed to %s the token: %w", action, err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+func (h *helperTokenStore) Get(endpoint string) (string, error) {
+	return h.run("get", endpoint, "", "")
+}
+
+func (h *helperTokenStore) Store(endpoint, login, token string) error {
+	_, err := h.run("store", endpoint, login, token+"\n")
+	return err
+}
+
+func (h *helperTokenStore) Erase(endpoint string) error {
+	_, err := h.run("erase", endpoint, "", "")
+	return err
+}
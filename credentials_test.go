@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// testTokenStoreRoundTrip stores, reads and erases the tokens of two endpoints
+func testTokenStoreRoundTrip(t *testing.T, store TokenStore) {
+	t.Helper()
+	const endpoint, other = "https://write.as", "https://blog.example.com"
+
+	for _, ep := range []string{endpoint, other} {
+		err := store.Store(ep, "user", "token for "+ep)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ep := range []string{endpoint, other} {
+		token, err := store.Get(ep)
+		if err != nil || token != "token for "+ep {
+			t.Errorf("unexpected token for %s: %q, %v", ep, token, err)
+		}
+	}
+
+	err := store.Erase(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := store.Get(endpoint)
+	if err != nil || token != "" {
+		t.Errorf("the token is not erased: %q, %v", token, err)
+	}
+	token, err = store.Get(other)
+	if err != nil || token != "token for "+other {
+		t.Errorf("the other token is erased: %q, %v", token, err)
+	}
+	err = store.Erase(endpoint)
+	if err != nil {
+		t.Errorf("erasing the missing token fails: %v", err)
+	}
+}
+
+func TestFileTokenStore(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "writeas-sync", CredentialsFileName)
+	store := &fileTokenStore{fileName: fileName}
+
+	token, err := store.Get("https://write.as")
+	if err != nil || token != "" {
+		t.Errorf("unexpected token without the file: %q, %v", token, err)
+	}
+	testTokenStoreRoundTrip(t, store)
+
+	st, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("the credentials file is readable by others: %v", st.Mode().Perm())
+	}
+
+	err = os.WriteFile(fileName, []byte("not json"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Get("https://write.as")
+	if err == nil {
+		t.Error("the broken credentials file is accepted")
+	}
+}
+
+// testCredentialHelper keeps the tokens in the files next to it, named after the endpoints
+const testCredentialHelper = `store="$(dirname "$0")/tokens"
+mkdir -p "$store"
+key=$(printf %s "$WRITEAS_ENDPOINT" | tr -c 'a-zA-Z0-9' _)
+case "$1" in
+get) cat "$store/$key" 2>/dev/null || true ;;
+store) cat > "$store/$key" && printf %s "$WRITEAS_LOGIN" > "$store/$key.login" ;;
+erase) rm -f "$store/$key" ;;
+*) exit 1 ;;
+esac
+`
+
+func TestHelperTokenStore(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to run the credential helper")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "helper.sh")
+	err := os.WriteFile(script, []byte(testCredentialHelper), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTokenStoreRoundTrip(t, NewTokenStore("sh "+script))
+
+	// The login is passed along with the token
+	login, err := os.ReadFile(filepath.Join(dir, "tokens", "https___blog_example_com.login"))
+	if err != nil || string(login) != "user" {
+		t.Errorf("the login is not passed to the helper: %q, %v", login, err)
+	}
+
+	_, err = NewTokenStore("exit 3;").Get("https://write.as")
+	if err == nil {
+		t.Error("the helper failure is not reported")
+	}
+}
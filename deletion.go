@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/writeas/go-writeas/v2"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+)
+
+// ArchiveDir is the directory (relative to the blog root) for the posts that have been deleted on the server
+const ArchiveDir = "_archive"
+
+// deletionAction plans the deletion of the post, unless the deletions are not allowed
+func (p *PostSynchronizer) deletionAction(slug, reason string, local *LocalPost,
+	remote *writeas.Post) PostAction {
+
+	if !p.opts.AllowDelete {
+		return PostAction{Kind: ActionSkip, Slug: slug, local: local, remote: remote,
+			Reason: reason + ", use --allow-delete to propagate the deletion"}
+	}
+	return PostAction{Kind: ActionDelete, Slug: slug, Reason: reason, local: local, remote: remote}
+}
+
+// stdinReader is shared by all the confirmations, a separate buffered reader for each of them could consume
+// the answers to the later ones when the input is piped
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// ConfirmDeletions prints the summary of the planned deletions and asks the user to confirm them. The
+// deletions are turned into no-ops if the user declines.
+func (p *PostSynchronizer) ConfirmDeletions(actions []PostAction, where string) []PostAction {
+	return confirmDeletions(actions, where, p.opts.AssumeYes, stdinReader, os.Stdout)
+}
+
+func confirmDeletions(actions []PostAction, where string, assumeYes bool,
+	in *bufio.Reader, out io.Writer) []PostAction {
+
+	var deletions []PostAction
+	for _, act := range actions {
+		if act.Kind == ActionDelete {
+			deletions = append(deletions, act)
+		}
+	}
+	if len(deletions) == 0 {
+		return actions
+	}
+
+	_, _ = fmt.Fprintf(out, "The following %d %s post(s) are going to be deleted:\n", len(deletions), where)
+	for _, act := range deletions {
+		_, _ = fmt.Fprintf(out, "  %s (%s)\n", act.Slug, act.Reason)
+	}
+
+	if assumeYes {
+		return actions
+	}
+
+	_, _ = fmt.Fprintf(out, "Proceed? [y/N] ")
+	answer, _ := in.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer == "y" || answer == "yes" {
+		return actions
+	}
+
+	slog.Default().Warn("Deletions are not confirmed, skipping them", slog.String("where", where))
+	var res []PostAction
+	for _, act := range actions {
+		if act.Kind == ActionDelete {
+			act.Kind = ActionSkip
+			act.Reason += ", not confirmed"
+		}
+		res = append(res, act)
+	}
+	return res
+}
+
+// deleteLocalPost removes the post file (or moves it into the archive) after it has been deleted on the server
+func (p *PostSynchronizer) deleteLocalPost(local LocalPost) error {
+	fullName := path.Join(p.rootDir, local.fname)
+
+	if p.opts.ArchiveDeleted {
+		archivedName := path.Join(p.rootDir, ArchiveDir, local.fname)
+		slog.Default().Info("Post has been deleted on the server, archiving it",
+			slog.String("slug", local.slug), slog.String("dest", archivedName))
+
+		err := os.MkdirAll(path.Dir(archivedName), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(fullName, archivedName)
+		if err != nil {
+			return err
+		}
+	} else {
+		slog.Default().Info("Post has been deleted on the server, deleting it locally",
+			slog.String("slug", local.slug), slog.String("file", local.fname))
+		err := os.Remove(fullName)
+		if err != nil {
+			return err
+		}
+	}
+
+	delete(p.posts, local.slug)
+	delete(p.state.Posts, local.slug)
+
+	return nil
+}
+
+// deleteRemotePost deletes the post on the server after it has been deleted locally
+func (p *PostSynchronizer) deleteRemotePost(ctx context.Context, remote writeas.Post) error {
+	slog.Default().Info("Post has been deleted locally, deleting it on the server",
+		slog.String("slug", remote.Slug), slog.String("id", remote.ID))
+
+	_, err := ReqWithRetries[bool](ctx, func() (bool, error) {
+		return true, p.client.DeletePost(remote.ID, "")
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(p.state.Posts, remote.Slug)
+
+	return nil
+}
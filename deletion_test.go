@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestConfirmDeletionsPipedAnswers(t *testing.T) {
+	in := bufio.NewReader(strings.NewReader("y\nn\n"))
+	actions := []PostAction{
+		{Kind: ActionUpdate, Slug: "kept"},
+		{Kind: ActionDelete, Slug: "gone", Reason: "deleted remotely"},
+	}
+
+	// Each answer goes to its own prompt
+	res := confirmDeletions(actions, "local", false, in, io.Discard)
+	if res[1].Kind != ActionDelete {
+		t.Errorf("the confirmed deletion is skipped: %+v", res[1])
+	}
+	res = confirmDeletions(actions, "remote", false, in, io.Discard)
+	if res[0].Kind != ActionUpdate || res[1].Kind != ActionSkip {
+		t.Errorf("the declined deletion is not skipped: %+v", res)
+	}
+	res = confirmDeletions(actions, "remote", true, in, io.Discard)
+	if res[1].Kind != ActionDelete {
+		t.Errorf("the deletion is not confirmed by --yes: %+v", res[1])
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FilesystemSync copies the images into a local directory that is published by a web server (directly, or
+// after being copied with rsync or a similar tool)
+type FilesystemSync struct {
+	*prefixHosting
+	imageDir string
+}
+
+var _ ImageSyncer = &FilesystemSync{}
+
+func NewFilesystemSync(rootDir, imageDir, remoteUrlRoot string) *FilesystemSync {
+	return &FilesystemSync{
+		prefixHosting: newPrefixHosting(rootDir, remoteUrlRoot),
+		imageDir:      imageDir,
+	}
+}
+
+func (f *FilesystemSync) Backend() string {
+	return "filesystem:" + f.remoteUrlRoot
+}
+
+func (f *FilesystemSync) BuildImageMap(ctx context.Context) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	err := filepath.WalkDir(f.imageDir, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Skip the hidden files, including the leftovers of the interrupted copies
+		if fullPath != f.imageDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.imageDir, fullPath)
+		if err != nil {
+			return err
+		}
+		relPath := filepath.ToSlash(rel)
+		imgUrl, err := f.imageUrl(relPath)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		f.fileMap[relPath] = RemoteImage{
+			Url:   imgUrl,
+			Mtime: info.ModTime(),
+			Size:  info.Size(),
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing has been published yet, the directory is created on the first upload
+		return nil
+	}
+	return err
+}
+
+func (f *FilesystemSync) EnsureLocalImageIsUploaded(ctx context.Context, img LocalImage) (string, error) {
+	if imgUrl, ok := f.FindUploadedImage(img); ok {
+		return imgUrl, nil
+	}
+	return f.UploadImage(ctx, img)
+}
+
+// copyImage copies the file atomically, preserving its mtime
+func copyImage(ctx context.Context, src, dst string) (os.FileInfo, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return stat, WriteFileAtomically(dst, 0644, stat.ModTime(), func(w io.Writer) error {
+		_, err := io.Copy(w, &contextReader{ctx: ctx, reader: file})
+		return err
+	})
+}
+
+func (f *FilesystemSync) UploadImage(ctx context.Context, img LocalImage) (string, error) {
+	slog.Default().Info("Publishing new or changed local image", slog.String("path", img.relPath),
+		slog.String("name", img.fullPath), slog.Int64("size", img.size))
+
+	imgUrl, err := f.imageUrl(img.relPath)
+	if err != nil {
+		return "", err
+	}
+
+	stat, err := copyImage(ctx, img.fullPath, filepath.Join(f.imageDir, filepath.FromSlash(img.relPath)))
+	if err != nil {
+		return "", err
+	}
+
+	f.setImage(img.relPath, RemoteImage{
+		Url:   imgUrl,
+		Mtime: stat.ModTime(),
+		Size:  stat.Size(),
+	})
+
+	slog.Default().Info("Published local image", slog.String("url", imgUrl))
+
+	return imgUrl, nil
+}
+
+func (f *FilesystemSync) DownloadAndSaveImage(ctx context.Context, fullImageUrl string, postDatePart string, postSlug string) (string, error) {
+	sanitizedRelPath, err := f.resolveDownloadPath(fullImageUrl)
+	if err != nil || sanitizedRelPath == "" {
+		return "", err
+	}
+
+	if current, msg := f.isLocalImageCurrent(sanitizedRelPath); current {
+		slog.Default().Info(msg, slog.String("dest", sanitizedRelPath))
+		return sanitizedRelPath, nil
+	}
+
+	slog.Default().Info("Copying the published image", slog.String("dest", sanitizedRelPath))
+
+	stat, err := copyImage(ctx, filepath.Join(f.imageDir, filepath.FromSlash(sanitizedRelPath)),
+		path.Join(f.rootDir, sanitizedRelPath))
+	if err != nil {
+		return "", err
+	}
+
+	f.setImage(sanitizedRelPath, RemoteImage{
+		Url:   fullImageUrl,
+		Mtime: stat.ModTime(),
+		Size:  stat.Size(),
+	})
+
+	return sanitizedRelPath, nil
+}
+
+func (f *FilesystemSync) DeleteHostedImage(ctx context.Context, img HostedImage) error {
+	err := os.Remove(filepath.Join(f.imageDir, filepath.FromSlash(img.id)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	f.removeImage(img.id)
+	return nil
+}
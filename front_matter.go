@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const frontMatterDelimiter = "---"
+
+// FrontMatter is the optional YAML metadata block at the beginning of the post
+type FrontMatter struct {
+	Title   string     `yaml:"title,omitempty"`
+	Slug    string     `yaml:"slug,omitempty"`
+	Created *time.Time `yaml:"created,omitempty"`
+	Tags    []string   `yaml:"tags,omitempty"`
+	Lang    string     `yaml:"lang,omitempty"`
+	RTL     *bool      `yaml:"rtl,omitempty"`
+	Font    string     `yaml:"font,omitempty"`
+	Draft   bool       `yaml:"draft,omitempty"`
+	Pinned  *bool      `yaml:"pinned,omitempty"`
+
+	// The original YAML is kept, so that the unknown keys and the formatting survive the round trip
+	raw   string
+	node  *yaml.Node
+	dirty bool
+}
+
+// SplitFrontMatter separates the YAML front matter from the post body. The returned front matter is nil
+// if the post doesn't have it.
+func SplitFrontMatter(content string) (*FrontMatter, string, error) {
+	firstLine, rest, found := strings.Cut(content, "\n")
+	if !found || strings.TrimRight(firstLine, " \t\r") != frontMatterDelimiter {
+		return nil, content, nil
+	}
+
+	// Find the closing delimiter
+	var yamlPart strings.Builder
+	for rest != "" {
+		var line string
+		line, rest, _ = strings.Cut(rest, "\n")
+		if strings.TrimRight(line, " \t\r") == frontMatterDelimiter {
+			fm, err := ParseFrontMatter(yamlPart.String())
+			if errors.Is(err, errNotFrontMatter) {
+				// The post starts with a thematic break, and has another one later
+				return nil, content, nil
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			return fm, rest, nil
+		}
+		yamlPart.WriteString(line)
+		yamlPart.WriteString("\n")
+	}
+
+	// No closing delimiter, so it's not a front matter
+	return nil, content, nil
+}
+
+// errNotFrontMatter is returned for the blocks that are not YAML mappings, so they are not the front matter
+var errNotFrontMatter = errors.New("the front matter is not a YAML mapping")
+
+func ParseFrontMatter(yamlText string) (*FrontMatter, error) {
+	fm := &FrontMatter{raw: yamlText}
+
+	node := &yaml.Node{}
+	err := yaml.Unmarshal([]byte(yamlText), node)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the front matter: %w", err)
+	}
+	if node.Kind == 0 {
+		// Empty front matter
+		return fm, nil
+	}
+	if len(node.Content) != 1 || node.Content[0].Kind != yaml.MappingNode {
+		return nil, errNotFrontMatter
+	}
+	fm.node = node.Content[0]
+
+	err = fm.node.Decode(fm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the front matter: %w", err)
+	}
+
+	return fm, nil
+}
+
+// Set updates the front matter key, the value must be of the same type as the corresponding FrontMatter field
+func (f *FrontMatter) Set(key string, value any) error {
+	if f.node == nil {
+		f.node = &yaml.Node{Kind: yaml.MappingNode}
+	}
+
+	newValue := &yaml.Node{}
+	err := newValue.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+1 < len(f.node.Content); i += 2 {
+		if f.node.Content[i].Value != key {
+			continue
+		}
+		var oldValue any
+		_ = f.node.Content[i+1].Decode(&oldValue)
+		var decodedNew any
+		_ = newValue.Decode(&decodedNew)
+		if reflect.DeepEqual(oldValue, decodedNew) {
+			return nil
+		}
+		f.node.Content[i+1] = newValue
+		f.dirty = true
+		return f.node.Decode(f)
+	}
+
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	f.node.Content = append(f.node.Content, keyNode, newValue)
+	f.dirty = true
+	return f.node.Decode(f)
+}
+
+// Render produces the front matter block, including the delimiters
+func (f *FrontMatter) Render() (string, error) {
+	yamlText := f.raw
+	if f.dirty {
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		err := enc.Encode(f.node)
+		if err != nil {
+			return "", err
+		}
+		_ = enc.Close()
+		yamlText = buf.String()
+	}
+
+	return frontMatterDelimiter + "\n" + yamlText + frontMatterDelimiter + "\n", nil
+}
+
+// TagsLine produces the hashtag line that Write.As uses to tag the posts
+func TagsLine(tags []string) string {
+	var res []string
+	for _, t := range tags {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "#")
+		if t != "" {
+			res = append(res, "#"+t)
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+// AppendTags adds the hashtags to the end of the post body, if it doesn't already end with them
+func AppendTags(body string, tags []string) string {
+	line := TagsLine(tags)
+	if line == "" || strings.HasSuffix(strings.TrimRight(body, "\n"), line) {
+		return body
+	}
+	return strings.TrimRight(body, "\n") + "\n\n" + line + "\n"
+}
+
+// SplitTags separates the hashtag line at the end of the downloaded post body. The tags are the ones of the
+// remote post that are on that line, the tags mentioned in the text stay there. The body is returned as is
+// if it doesn't end with a hashtag line.
+func SplitTags(body string, remoteTags []string) (string, []string) {
+	trimmed := strings.TrimRight(body, "\n")
+	idx := strings.LastIndex(trimmed, "\n\n")
+	if idx < 0 {
+		return body, nil
+	}
+	fields := strings.Fields(trimmed[idx+2:])
+	if len(fields) == 0 {
+		return body, nil
+	}
+	onLine := make(map[string]bool)
+	var lineTags []string
+	for _, f := range fields {
+		tag := strings.TrimPrefix(f, "#")
+		if !strings.HasPrefix(f, "#") || tag == "" || strings.Contains(tag, "#") {
+			return body, nil
+		}
+		onLine[strings.ToLower(tag)] = true
+		lineTags = append(lineTags, tag)
+	}
+
+	tags := lineTags
+	if len(remoteTags) > 0 {
+		tags = nil
+		for _, t := range remoteTags {
+			if onLine[strings.ToLower(t)] {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return trimmed[:idx] + "\n", tags
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+	fm, body, err := SplitFrontMatter("---\ntitle: Hello\ntags: [a, b]\n---\nText\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fm == nil || fm.Title != "Hello" || !reflect.DeepEqual(fm.Tags, []string{"a", "b"}) {
+		t.Errorf("unexpected front matter: %+v", fm)
+	}
+	if body != "Text\n" {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+func TestSplitFrontMatterThematicBreak(t *testing.T) {
+	content := "---\nSome text\n\n---\nMore text\n"
+	fm, body, err := SplitFrontMatter(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fm != nil {
+		t.Errorf("unexpected front matter: %+v", fm)
+	}
+	if body != content {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+func TestSplitFrontMatterNotMapping(t *testing.T) {
+	for _, content := range []string{"---\n- a list\n---\nText\n", "---\n42\n---\nText\n"} {
+		fm, body, err := SplitFrontMatter(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fm != nil || body != content {
+			t.Errorf("the block is not kept in the body: %+v, %q", fm, body)
+		}
+	}
+}
+
+func TestSplitFrontMatterSyntaxError(t *testing.T) {
+	_, _, err := SplitFrontMatter("---\ntitle: [Hello\n---\nText\n")
+	if err == nil {
+		t.Error("the broken front matter is published as the body")
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		remoteTags []string
+		wantBody   string
+		wantTags   []string
+	}{
+		{
+			name:     "no tags line",
+			body:     "Text\n\nMore text\n",
+			wantBody: "Text\n\nMore text\n",
+		},
+		{
+			name:       "remote tags",
+			body:       "Text\n\n#go #Sync\n",
+			remoteTags: []string{"sync", "go"},
+			wantBody:   "Text\n",
+			wantTags:   []string{"sync", "go"},
+		},
+		{
+			name:       "tag removed remotely",
+			body:       "Text\n\n#go\n",
+			remoteTags: []string{"go", "inline"},
+			wantBody:   "Text\n",
+			wantTags:   []string{"go"},
+		},
+		{
+			name:     "no remote tags",
+			body:     "Text\n\n#go #sync\n",
+			wantBody: "Text\n",
+			wantTags: []string{"go", "sync"},
+		},
+		{
+			name:       "hashtags mixed with text",
+			body:       "Text\n\nAbout #go\n",
+			remoteTags: []string{"go"},
+			wantBody:   "Text\n\nAbout #go\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, tags := SplitTags(tt.body, tt.remoteTags)
+			if body != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+			if !reflect.DeepEqual(tags, tt.wantTags) {
+				t.Errorf("tags = %v, want %v", tags, tt.wantTags)
+			}
+		})
+	}
+}
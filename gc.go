@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/writeas/go-writeas/v2"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultGcGracePeriod protects the recently uploaded images, their posts might not be uploaded yet
+const DefaultGcGracePeriod = 7 * 24 * time.Hour
+
+// GcOptions controls the removal of the unreferenced images
+type GcOptions struct {
+	// Apply deletes the images, otherwise they are only listed
+	Apply bool
+	// DryRun only lists the images, even if Apply is set
+	DryRun bool
+	// GracePeriod keeps the images that are younger than that
+	GracePeriod time.Duration
+	// Protect lists the prefixes of the image paths or URLs that are never deleted
+	Protect []string
+}
+
+// FindUnreferencedImages lists the hosted images that are not referenced by any local or remote post. The
+// remote posts must include all the user's posts, because the image hosting can be shared between the blogs.
+func (p *PostSynchronizer) FindUnreferencedImages(remotePosts []writeas.Post, opts GcOptions) ([]HostedImage, error) {
+	referenced := make(map[string]bool)
+	for _, post := range remotePosts {
+		addReferencedUrls(referenced, post.Content)
+	}
+
+	for _, slug := range p.sortedSlugs() {
+		local := p.posts[slug]
+		addReferencedUrls(referenced, local.body)
+		for _, img := range local.images {
+			if imgUrl, ok := p.imageSyncer.FindUploadedImage(img); ok {
+				referenced[urlWithoutQuery(imgUrl)] = true
+			}
+			hash, err := p.imageHash(img)
+			if err != nil {
+				return nil, err
+			}
+			if imgUrl, found, _ := p.findIndexedImage(img, hash); found {
+				referenced[urlWithoutQuery(imgUrl)] = true
+			}
+		}
+	}
+
+	var res []HostedImage
+	for _, img := range p.imageSyncer.HostedImages() {
+		if referenced[urlWithoutQuery(img.Url)] || time.Since(img.Created) < opts.GracePeriod ||
+			isProtectedImage(img, opts.Protect) {
+			continue
+		}
+		res = append(res, img)
+	}
+
+	slices.SortFunc(res, func(a, b HostedImage) int {
+		return strings.Compare(a.Url, b.Url)
+	})
+	return res, nil
+}
+
+// addReferencedUrls collects all the destinations in the post. They are not filtered by the synchronized
+// media types, because the hosted images might have been uploaded with a different configuration.
+func addReferencedUrls(referenced map[string]bool, content string) {
+	for _, ref := range FindMediaReferences([]byte(content)) {
+		referenced[urlWithoutQuery(ref.Dest)] = true
+	}
+}
+
+// urlWithoutQuery strips the query and the fragment, they don't change the referenced file
+func urlWithoutQuery(imgUrl string) string {
+	if idx := strings.IndexAny(imgUrl, "?#"); idx >= 0 {
+		return imgUrl[:idx]
+	}
+	return imgUrl
+}
+
+func isProtectedImage(img HostedImage, protect []string) bool {
+	for _, prefix := range protect {
+		if strings.HasPrefix(img.Url, prefix) || (img.Name != "" && strings.HasPrefix(img.Name, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteHostedImages removes the images from the image hosting and from the image index
+func (p *PostSynchronizer) DeleteHostedImages(ctx context.Context, images []HostedImage) error {
+	for _, img := range images {
+		slog.Default().Info("Deleting the unreferenced image", slog.String("url", img.Url))
+		err := p.imageSyncer.DeleteHostedImage(ctx, img)
+		if err != nil {
+			return err
+		}
+
+		p.imagesMtx.Lock()
+		for relPath, indexed := range p.state.Images {
+			if indexed.Url == img.Url {
+				delete(p.state.Images, relPath)
+			}
+		}
+		p.imagesMtx.Unlock()
+	}
+	return nil
+}
+
+// doGc lists the unreferenced images, and deletes them if requested
+func doGc(ctx context.Context, conv ImageSyncer, ps *PostSynchronizer, opts GcOptions, out io.Writer) error {
+	remotePosts, err := loadSyncInputs(ctx, conv, ps)
+	if err != nil {
+		return err
+	}
+
+	slog.Default().Info("Fetching all the user's posts")
+	userPosts, err := ReqWithRetries[*[]writeas.Post](ctx, func() (*[]writeas.Post, error) {
+		return ps.client.GetUserPosts()
+	})
+	if err != nil {
+		return err
+	}
+	remotePosts = append(remotePosts, *userPosts...)
+
+	unreferenced, err := ps.FindUnreferencedImages(remotePosts, opts)
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(out, "Unreferenced images:\n")
+	if len(unreferenced) == 0 {
+		_, _ = fmt.Fprintf(out, "  (nothing to do)\n")
+		return nil
+	}
+	for _, img := range unreferenced {
+		name := img.Name
+		if name == "" {
+			name = "unknown path"
+		}
+		_, _ = fmt.Fprintf(out, "  %s (%s, uploaded %s)\n", img.Url, name, img.Created.Format(time.DateOnly))
+	}
+
+	if !opts.Apply {
+		_, _ = fmt.Fprintf(out, "Use --apply to delete them\n")
+		return nil
+	}
+	if opts.DryRun {
+		_, _ = fmt.Fprintf(out, "Dry run, not deleting them\n")
+		return nil
+	}
+
+	return saveStateAfter(ps, ps.DeleteHostedImages(ctx, unreferenced))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/writeas/go-writeas/v2"
+)
+
+func TestFindUnreferencedImages(t *testing.T) {
+	err := SetMediaTypes([]string{"png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetMediaTypes(DefaultMediaTypes) })
+
+	rootDir, imageDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"photo.jpg", "versioned.png", "linked.png", "unused.png"} {
+		writeTestImage(t, filepath.Join(imageDir, name))
+	}
+	syncer := NewFilesystemSync(rootDir, imageDir, testImageUrlRoot)
+	err = syncer.BuildImageMap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPostSynchronizer(syncer, nil, rootDir, "blog", SyncOptions{})
+	remotePosts := []writeas.Post{{
+		Content: "![Photo](" + testImageUrlRoot + "/photo.jpg)\n\n" +
+			"![Versioned](" + testImageUrlRoot + "/versioned.png?v=2)\n\n" +
+			"[Linked](" + testImageUrlRoot + "/linked.png#top)\n",
+	}}
+	unreferenced, err := p.FindUnreferencedImages(remotePosts, GcOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unreferenced) != 1 || unreferenced[0].Name != "unused.png" {
+		t.Errorf("unexpected unreferenced images: %+v", unreferenced)
+	}
+}
+
+func TestGcDryRun(t *testing.T) {
+	err := SetMediaTypes([]string{"png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetMediaTypes(DefaultMediaTypes) })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/collections/blog/posts":
+			coll := map[string]any{"posts": []writeas.Post{}}
+			_ = json.NewEncoder(w).Encode(map[string]any{"code": http.StatusOK, "data": coll})
+		case "/me/posts":
+			_ = json.NewEncoder(w).Encode(map[string]any{"code": http.StatusOK, "data": []writeas.Post{}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	rootDir, imageDir := t.TempDir(), t.TempDir()
+	unused := filepath.Join(imageDir, "unused.png")
+	writeTestImage(t, unused)
+	syncer := NewFilesystemSync(rootDir, imageDir, testImageUrlRoot)
+	p := NewPostSynchronizer(syncer, writeas.NewClientWith(writeas.Config{URL: srv.URL}), rootDir, "blog",
+		SyncOptions{})
+
+	var out bytes.Buffer
+	err = doGc(context.Background(), syncer, p, GcOptions{Apply: true, DryRun: true}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), testImageUrlRoot+"/unused.png") {
+		t.Errorf("the unreferenced image is not listed: %s", out.String())
+	}
+	if _, err := os.Stat(unused); err != nil {
+		t.Errorf("the image is deleted in the dry-run mode: %v", err)
+	}
+}
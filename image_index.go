@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/writeas/go-writeas/v2"
+	"io"
+	"os"
+	"time"
+)
+
+// ImageSyncState records an uploaded image, so that the edited images are re-uploaded, and the identical
+// images at different paths share one remote copy
+type ImageSyncState struct {
+	Url     string    `json:"url"`
+	Backend string    `json:"backend"`
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	Mtime   time.Time `json:"mtime"`
+}
+
+// FileHash computes the SHA-256 of the file contents
+func FileHash(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// imageHash returns the content hash of the local image. The hash from the index is reused if the image
+// size and mtime haven't changed since it was recorded.
+func (p *PostSynchronizer) imageHash(img LocalImage) (string, error) {
+	p.imagesMtx.Lock()
+	if hash, ok := p.imageHashes[img.relPath]; ok {
+		p.imagesMtx.Unlock()
+		return hash, nil
+	}
+	indexed, ok := p.state.Images[img.relPath]
+	p.imagesMtx.Unlock()
+
+	if ok && indexed.Size == img.size && indexed.Mtime.Equal(img.mtime) {
+		return indexed.Hash, nil
+	}
+
+	hash, err := FileHash(img.fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	p.imagesMtx.Lock()
+	defer p.imagesMtx.Unlock()
+	p.imageHashes[img.relPath] = hash
+	return hash, nil
+}
+
+// findIndexedImage looks up the uploaded copy of the image in the index. The image with the same contents at
+// a different path is reused. Otherwise, the image is "changed" if it has been uploaded before, but its contents
+// are different now.
+func (p *PostSynchronizer) findIndexedImage(img LocalImage, hash string) (imgUrl string, found bool, changed bool) {
+	backend := p.imageSyncer.Backend()
+
+	p.imagesMtx.Lock()
+	defer p.imagesMtx.Unlock()
+
+	own, ok := p.state.Images[img.relPath]
+	uploaded := ok && own.Backend == backend
+	if uploaded && own.Hash == hash {
+		return own.Url, true, false
+	}
+
+	// The new contents might have been uploaded from a different path already
+	for _, indexed := range p.state.Images {
+		if indexed.Backend == backend && indexed.Hash == hash {
+			return indexed.Url, true, false
+		}
+	}
+
+	return "", false, uploaded
+}
+
+// uploadedImageUrl returns the URL of the uploaded copy of the image from the index
+func (p *PostSynchronizer) uploadedImageUrl(img LocalImage) (string, bool) {
+	p.imagesMtx.Lock()
+	defer p.imagesMtx.Unlock()
+
+	indexed, ok := p.state.Images[img.relPath]
+	if !ok || indexed.Backend != p.imageSyncer.Backend() {
+		return "", false
+	}
+	return indexed.Url, true
+}
+
+func (p *PostSynchronizer) recordImage(img LocalImage, imgUrl, hash string) {
+	p.imagesMtx.Lock()
+	defer p.imagesMtx.Unlock()
+
+	p.state.Images[img.relPath] = ImageSyncState{
+		Url:     imgUrl,
+		Backend: p.imageSyncer.Backend(),
+		Hash:    hash,
+		Size:    img.size,
+		Mtime:   img.mtime,
+	}
+}
+
+// recordSynced remembers the post as being identical on both sides, along with the hashes of its images
+func (p *PostSynchronizer) recordSynced(slug string, localContent string, remote writeas.Post) {
+	p.state.RecordSynced(slug, localContent, remote)
+
+	local, ok := p.posts[slug]
+	if !ok {
+		return
+	}
+
+	st := p.state.Posts[slug]
+	st.File = local.fname
+	p.state.Posts[slug] = st
+	if len(local.images) == 0 {
+		return
+	}
+
+	st.Images = make(map[string]string)
+	for _, img := range local.images {
+		hash, err := p.imageHash(img)
+		if err == nil {
+			st.Images[img.relPath] = hash
+		}
+	}
+	p.state.Posts[slug] = st
+}
+
+// changedImage finds an image of the post that has changed since the post was uploaded, the post needs to be
+// re-uploaded to reference its new copy
+func (p *PostSynchronizer) changedImage(local LocalPost) string {
+	recorded := p.state.Posts[local.slug].Images
+	for _, img := range local.images {
+		oldHash, ok := recorded[img.relPath]
+		if !ok {
+			continue
+		}
+		hash, err := p.imageHash(img)
+		if err == nil && hash != oldHash {
+			return img.relPath
+		}
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestImageIndex(t *testing.T) (*PostSynchronizer, LocalImage) {
+	t.Helper()
+	rootDir := t.TempDir()
+	fullPath := filepath.Join(rootDir, "img/a.png")
+	writeTestImage(t, fullPath)
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := LocalImage{fullPath: fullPath, relPath: "img/a.png", mediaType: "image/png",
+		size: stat.Size(), mtime: stat.ModTime()}
+
+	syncer := NewFilesystemSync(rootDir, t.TempDir(), testImageUrlRoot)
+	return NewPostSynchronizer(syncer, nil, rootDir, "blog", SyncOptions{}), img
+}
+
+func TestImageHash(t *testing.T) {
+	p, img := newTestImageIndex(t)
+	fileHash, err := FileHash(img.fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The indexed hash is trusted while the size and mtime are the same
+	p.state.Images[img.relPath] = ImageSyncState{Hash: "indexed", Size: img.size, Mtime: img.mtime}
+	hash, err := p.imageHash(img)
+	if err != nil || hash != "indexed" {
+		t.Errorf("the indexed hash is not reused: %s, %v", hash, err)
+	}
+
+	touched := img
+	touched.mtime = img.mtime.Add(time.Second)
+	hash, err = p.imageHash(touched)
+	if err != nil || hash != fileHash {
+		t.Errorf("the hash is not computed: %s, %v", hash, err)
+	}
+
+	// The computed hash is cached for the rest of the run
+	err = os.WriteFile(img.fullPath, []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err = p.imageHash(touched)
+	if err != nil || hash != fileHash {
+		t.Errorf("the hash is not cached: %s, %v", hash, err)
+	}
+}
+
+func TestFindIndexedImage(t *testing.T) {
+	p, img := newTestImageIndex(t)
+	backend := p.imageSyncer.Backend()
+
+	tests := []struct {
+		name        string
+		index       map[string]ImageSyncState
+		wantUrl     string
+		wantChanged bool
+	}{
+		{name: "new image"},
+		{
+			name:    "unchanged",
+			index:   map[string]ImageSyncState{"img/a.png": {Url: "a-url", Backend: backend, Hash: "new"}},
+			wantUrl: "a-url",
+		},
+		{
+			name:        "changed",
+			index:       map[string]ImageSyncState{"img/a.png": {Url: "a-url", Backend: backend, Hash: "old"}},
+			wantChanged: true,
+		},
+		{
+			name: "changed to a copy of an uploaded image",
+			index: map[string]ImageSyncState{
+				"img/a.png": {Url: "a-url", Backend: backend, Hash: "old"},
+				"img/b.png": {Url: "b-url", Backend: backend, Hash: "new"},
+			},
+			wantUrl: "b-url",
+		},
+		{
+			name:    "copy of an uploaded image",
+			index:   map[string]ImageSyncState{"img/b.png": {Url: "b-url", Backend: backend, Hash: "new"}},
+			wantUrl: "b-url",
+		},
+		{
+			name: "uploaded to another hosting",
+			index: map[string]ImageSyncState{
+				"img/a.png": {Url: "a-url", Backend: "other", Hash: "old"},
+				"img/b.png": {Url: "b-url", Backend: "other", Hash: "new"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.state.Images = tt.index
+			imgUrl, found, changed := p.findIndexedImage(img, "new")
+			if imgUrl != tt.wantUrl || found != (tt.wantUrl != "") || changed != tt.wantChanged {
+				t.Errorf("got %q, %t, %t", imgUrl, found, changed)
+			}
+		})
+	}
+}
+
+func TestChangedImage(t *testing.T) {
+	p, img := newTestImageIndex(t)
+	hash, err := FileHash(img.fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := LocalPost{slug: "hello", images: []LocalImage{img}}
+
+	p.state.Posts["hello"] = PostSyncState{Images: map[string]string{img.relPath: hash}}
+	if changed := p.changedImage(post); changed != "" {
+		t.Errorf("the unchanged image is reported: %s", changed)
+	}
+
+	p.state.Posts["hello"] = PostSyncState{Images: map[string]string{img.relPath: "old"}}
+	if changed := p.changedImage(post); changed != img.relPath {
+		t.Errorf("the changed image is not reported: %q", changed)
+	}
+
+	// The images added after the upload are not "changed", the post itself has changed then
+	p.state.Posts["hello"] = PostSyncState{}
+	if changed := p.changedImage(post); changed != "" {
+		t.Errorf("the new image is reported: %s", changed)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+var jpegExifHeader = []byte("Exif\x00\x00")
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// jpegSegment is a marker segment of the JPEG header, the data includes the marker and the length
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+	data    []byte
+}
+
+// splitJpeg splits the JPEG file into the header segments and the rest, starting with the scan data
+func splitJpeg(data []byte) ([]jpegSegment, []byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, fmt.Errorf("not a JPEG file")
+	}
+
+	var segments []jpegSegment
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, nil, fmt.Errorf("invalid JPEG marker at %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// The start of the scan, the rest of the file is the image data
+			return segments, data[pos:], nil
+		}
+		if marker == 0xFF {
+			pos++ // A fill byte
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// The standalone markers without the length
+			segments = append(segments, jpegSegment{marker: marker, data: data[pos : pos+2]})
+			pos += 2
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, nil, fmt.Errorf("invalid JPEG segment length at %d", pos)
+		}
+		segments = append(segments, jpegSegment{
+			marker:  marker,
+			payload: data[pos+4 : pos+2+length],
+			data:    data[pos : pos+2+length],
+		})
+		pos += 2 + length
+	}
+	return nil, nil, fmt.Errorf("truncated JPEG file")
+}
+
+// isJpegMetadata checks if the segment holds the metadata: EXIF and XMP (APP1), IPTC (APP13) or a comment.
+// The color profile (APP2) and the color transform (APP14) segments affect the rendering, so they are kept.
+func isJpegMetadata(marker byte) bool {
+	return marker == 0xE1 || marker == 0xED || marker == 0xFE
+}
+
+// stripJpegMetadata removes the metadata segments without re-encoding the image. The EXIF orientation (if it's
+// not the default one) is kept, it's the only EXIF tag left.
+func stripJpegMetadata(data []byte) ([]byte, error) {
+	orientation := exifOrientation(jpegExif(data))
+	segments, rest, err := splitJpeg(data)
+	if err != nil {
+		return nil, err
+	}
+
+	res := bytes.NewBuffer(make([]byte, 0, len(data)))
+	res.Write(data[:2])
+	for i, seg := range segments {
+		// The EXIF segment goes right after the JFIF one, or first
+		if orientation != 1 && i == 0 && seg.marker != 0xE0 {
+			res.Write(orientationExifSegment(orientation))
+		}
+		if !isJpegMetadata(seg.marker) {
+			res.Write(seg.data)
+		}
+		if orientation != 1 && i == 0 && seg.marker == 0xE0 {
+			res.Write(orientationExifSegment(orientation))
+		}
+	}
+	res.Write(rest)
+	return res.Bytes(), nil
+}
+
+// jpegExif returns the TIFF structure from the EXIF segment, it's nil if there's none
+func jpegExif(data []byte) []byte {
+	segments, _, err := splitJpeg(data)
+	if err != nil {
+		return nil
+	}
+	for _, seg := range segments {
+		if seg.marker == 0xE1 && bytes.HasPrefix(seg.payload, jpegExifHeader) {
+			return seg.payload[len(jpegExifHeader):]
+		}
+	}
+	return nil
+}
+
+// pngMetadataChunks are the ancillary chunks with the text, the EXIF data and the modification time
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+// stripPngMetadata removes the metadata chunks without re-encoding the image
+func stripPngMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+
+	res := bytes.NewBuffer(make([]byte, 0, len(data)))
+	res.Write(pngSignature)
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("truncated PNG chunk at %d", pos)
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		// The length, the type, the data and the CRC
+		end := pos + 12 + length
+		if end > len(data) {
+			return nil, fmt.Errorf("invalid PNG chunk length at %d", pos)
+		}
+		if !pngMetadataChunks[chunkType] {
+			res.Write(data[pos:end])
+		}
+		pos = end
+	}
+	return res.Bytes(), nil
+}
+
+// tiffReader reads the IFD entries of the EXIF data, see the TIFF 6.0 specification
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTiffReader(data []byte) (*tiffReader, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("truncated TIFF header")
+	}
+	switch string(data[:2]) {
+	case "II":
+		return &tiffReader{data: data, order: binary.LittleEndian}, nil
+	case "MM":
+		return &tiffReader{data: data, order: binary.BigEndian}, nil
+	}
+	return nil, fmt.Errorf("invalid TIFF byte order")
+}
+
+type tiffEntry struct {
+	tag, kind uint16
+	count     uint32
+	// value is either the value itself (if it fits into 4 bytes) or its offset
+	value []byte
+}
+
+// firstIfd returns the offset of IFD0
+func (t *tiffReader) firstIfd() uint32 {
+	return t.order.Uint32(t.data[4:])
+}
+
+// readIfd reads the entries of the IFD at the offset
+func (t *tiffReader) readIfd(offset uint32) ([]tiffEntry, error) {
+	if int64(offset)+2 > int64(len(t.data)) {
+		return nil, fmt.Errorf("invalid IFD offset")
+	}
+	num := int(t.order.Uint16(t.data[offset:]))
+	start := int(offset) + 2
+	if start+num*12 > len(t.data) {
+		return nil, fmt.Errorf("truncated IFD")
+	}
+
+	entries := make([]tiffEntry, num)
+	for i := range entries {
+		e := t.data[start+i*12:]
+		entries[i] = tiffEntry{
+			tag:   t.order.Uint16(e),
+			kind:  t.order.Uint16(e[2:]),
+			count: t.order.Uint32(e[4:]),
+			value: e[8:12],
+		}
+	}
+	return entries, nil
+}
+
+// uint reads a SHORT or LONG value
+func (t *tiffReader) uint(e tiffEntry) uint32 {
+	if e.kind == 3 {
+		return uint32(t.order.Uint16(e.value))
+	}
+	return t.order.Uint32(e.value)
+}
+
+const exifTagOrientation = 0x0112
+
+// exifOrientation returns the orientation from the EXIF data (1 to 8), 1 is the normal orientation
+func exifOrientation(exif []byte) int {
+	tiff, err := newTiffReader(exif)
+	if err != nil {
+		return 1
+	}
+	entries, err := tiff.readIfd(tiff.firstIfd())
+	if err != nil {
+		return 1
+	}
+	for _, e := range entries {
+		if e.tag == exifTagOrientation {
+			if o := int(tiff.uint(e)); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+const exifTagGpsIfd = 0x8825
+
+// pngExif returns the TIFF structure from the eXIf chunk, it's nil if there's none
+func pngExif(data []byte) []byte {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if end > len(data) {
+			return nil
+		}
+		if string(data[pos+4:pos+8]) == "eXIf" {
+			return data[pos+8 : pos+8+length]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// exifHasGps checks if the EXIF data has a non-empty GPS section
+func exifHasGps(exif []byte) bool {
+	tiff, err := newTiffReader(exif)
+	if err != nil {
+		return false
+	}
+	entries, err := tiff.readIfd(tiff.firstIfd())
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.tag == exifTagGpsIfd {
+			gps, err := tiff.readIfd(tiff.uint(e))
+			return err == nil && len(gps) > 0
+		}
+	}
+	return false
+}
+
+// HasGpsLocation checks if the JPEG or PNG image has the GPS location in its EXIF or XMP metadata
+func HasGpsLocation(data []byte) bool {
+	if bytes.HasPrefix(data, pngSignature) {
+		return exifHasGps(pngExif(data)) || bytes.Contains(data, []byte("GPSLatitude"))
+	}
+
+	segments, _, err := splitJpeg(data)
+	if err != nil {
+		return false
+	}
+	for _, seg := range segments {
+		if seg.marker != 0xE1 {
+			continue
+		}
+		if bytes.HasPrefix(seg.payload, jpegExifHeader) {
+			if exifHasGps(seg.payload[len(jpegExifHeader):]) {
+				return true
+			}
+		} else if bytes.Contains(seg.payload, []byte("GPSLatitude")) {
+			// The XMP metadata
+			return true
+		}
+	}
+	return false
+}
+
+// orientationExifSegment builds the EXIF segment that has only the orientation tag
+func orientationExifSegment(orientation int) []byte {
+	payload := bytes.NewBuffer(nil)
+	payload.Write(jpegExifHeader)
+	// The TIFF header, and IFD0 right after it with a single SHORT entry and no next IFD
+	payload.Write([]byte{'M', 'M', 0, 0x2A, 0, 0, 0, 8})
+	_ = binary.Write(payload, binary.BigEndian, []uint16{1, exifTagOrientation, 3})
+	_ = binary.Write(payload, binary.BigEndian, []uint32{1})
+	_ = binary.Write(payload, binary.BigEndian, []uint16{uint16(orientation), 0})
+	_ = binary.Write(payload, binary.BigEndian, []uint32{0})
+
+	seg := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(payload.Len()+2))
+	return append(seg, payload.Bytes()...)
+}
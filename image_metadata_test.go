@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testExif builds the TIFF structure with the orientation tag and, optionally, a GPS IFD with the latitude reference
+func testExif(order binary.ByteOrder, orientation uint16, gps bool) []byte {
+	var buf bytes.Buffer
+	if order == binary.BigEndian {
+		buf.WriteString("MM")
+	} else {
+		buf.WriteString("II")
+	}
+	_ = binary.Write(&buf, order, uint16(42))
+	_ = binary.Write(&buf, order, uint32(8))
+
+	entries := uint16(1)
+	if gps {
+		entries = 2
+	}
+	_ = binary.Write(&buf, order, entries)
+	_ = binary.Write(&buf, order, []uint16{exifTagOrientation, 3})
+	_ = binary.Write(&buf, order, uint32(1))
+	_ = binary.Write(&buf, order, []uint16{orientation, 0})
+	if gps {
+		// The GPS IFD goes right after IFD0: the header, the entry count, two entries and the next IFD offset
+		_ = binary.Write(&buf, order, []uint16{exifTagGpsIfd, 4})
+		_ = binary.Write(&buf, order, []uint32{1, 8 + 2 + 2*12 + 4})
+	}
+	_ = binary.Write(&buf, order, uint32(0))
+
+	if gps {
+		// GPSLatitudeRef = "N"
+		_ = binary.Write(&buf, order, uint16(1))
+		_ = binary.Write(&buf, order, []uint16{1, 2})
+		_ = binary.Write(&buf, order, uint32(2))
+		buf.Write([]byte{'N', 0, 0, 0})
+		_ = binary.Write(&buf, order, uint32(0))
+	}
+	return buf.Bytes()
+}
+
+func testJpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+func testExifSegment(order binary.ByteOrder, orientation uint16, gps bool) []byte {
+	return testJpegSegment(0xE1, append(bytes.Clone(jpegExifHeader), testExif(order, orientation, gps)...))
+}
+
+func testPngChunk(chunkType string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// testJpeg encodes a w x h JPEG image and inserts the segments right after the SOI marker
+func testJpeg(t *testing.T, w, h int, segments ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	res := append([]byte{}, data[:2]...)
+	for _, seg := range segments {
+		res = append(res, seg...)
+	}
+	return append(res, data[2:]...)
+}
+
+// testPng encodes a w x h PNG image and inserts the chunks right after the IHDR chunk
+func testPng(t *testing.T, w, h int, chunks ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The signature and the IHDR chunk with its 13 bytes of data
+	ihdrEnd := len(pngSignature) + 12 + 13
+	res := append([]byte{}, data[:ihdrEnd]...)
+	for _, chunk := range chunks {
+		res = append(res, chunk...)
+	}
+	return append(res, data[ihdrEnd:]...)
+}
+
+var testXmpGps = append([]byte("http://ns.adobe.com/xap/1.0/\x00"),
+	`<x:xmpmeta xmlns:x="adobe:ns:meta/"><exif:GPSLatitude>55,45.0N</exif:GPSLatitude></x:xmpmeta>`...)
+
+var testIptc = []byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00\x00\x00\x00\x05\x1c\x02\x05\x00\x00")
+
+func TestSplitJpeg(t *testing.T) {
+	data := testJpeg(t, 2, 2, testExifSegment(binary.LittleEndian, 6, false), testJpegSegment(0xFE, []byte("comment")))
+
+	segments, rest, err := splitJpeg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 || segments[0].marker != 0xE1 || segments[1].marker != 0xFE ||
+		string(segments[1].payload) != "comment" {
+		t.Errorf("unexpected segments: %+v", segments)
+	}
+	if len(rest) < 2 || rest[0] != 0xFF || rest[1] != 0xDA {
+		t.Errorf("the rest doesn't start with the scan")
+	}
+
+	for _, broken := range [][]byte{nil, []byte("GIF89a"), data[:len(data)-len(rest)-1]} {
+		_, _, err = splitJpeg(broken)
+		if err == nil {
+			t.Errorf("the broken JPEG is split: %q", broken)
+		}
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		exif []byte
+		want int
+	}{
+		{name: "none", want: 1},
+		{name: "little endian", exif: testExif(binary.LittleEndian, 6, true), want: 6},
+		{name: "big endian", exif: testExif(binary.BigEndian, 8, false), want: 8},
+		{name: "invalid", exif: testExif(binary.BigEndian, 9, false), want: 1},
+		{name: "truncated", exif: testExif(binary.BigEndian, 3, false)[:12], want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exifOrientation(tt.exif); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasGpsLocation(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{name: "jpeg without metadata", data: testJpeg(t, 2, 2)},
+		{name: "jpeg exif", data: testJpeg(t, 2, 2, testExifSegment(binary.LittleEndian, 1, false))},
+		{name: "jpeg exif gps", data: testJpeg(t, 2, 2, testExifSegment(binary.LittleEndian, 1, true)),
+			want: true},
+		{name: "jpeg big endian gps", data: testJpeg(t, 2, 2, testExifSegment(binary.BigEndian, 1, true)),
+			want: true},
+		{name: "jpeg xmp gps", data: testJpeg(t, 2, 2, testJpegSegment(0xE1, testXmpGps)), want: true},
+		{name: "png without metadata", data: testPng(t, 2, 2)},
+		{name: "png exif", data: testPng(t, 2, 2, testPngChunk("eXIf", testExif(binary.BigEndian, 1, false)))},
+		{name: "png exif gps", data: testPng(t, 2, 2, testPngChunk("eXIf", testExif(binary.BigEndian, 1, true))),
+			want: true},
+		{name: "png xmp gps", data: testPng(t, 2, 2, testPngChunk("iTXt", testXmpGps)), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HasGpsLocation(tt.data); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripJpegMetadata(t *testing.T) {
+	data := testJpeg(t, 2, 2,
+		testExifSegment(binary.LittleEndian, 6, true),
+		testJpegSegment(0xE1, testXmpGps),
+		testJpegSegment(0xED, testIptc),
+		testJpegSegment(0xFE, []byte("comment")))
+
+	stripped, err := stripJpegMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, _, err := splitJpeg(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata []jpegSegment
+	for _, seg := range segments {
+		if isJpegMetadata(seg.marker) {
+			metadata = append(metadata, seg)
+		}
+	}
+	// Only the EXIF segment with the orientation is left
+	if len(metadata) != 1 || !bytes.Equal(metadata[0].data, orientationExifSegment(6)) {
+		t.Errorf("unexpected metadata segments: %+v", metadata)
+	}
+	if exifOrientation(jpegExif(stripped)) != 6 || HasGpsLocation(stripped) {
+		t.Error("the orientation is lost or the GPS location is kept")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("the stripped image is broken: %v", err)
+	}
+
+	// The default orientation is not stored
+	stripped, err = stripJpegMetadata(testJpeg(t, 2, 2, testJpegSegment(0xE1, testXmpGps)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jpegExif(stripped) != nil || HasGpsLocation(stripped) {
+		t.Error("the metadata is kept")
+	}
+}
+
+func TestStripPngMetadata(t *testing.T) {
+	data := testPng(t, 2, 2,
+		testPngChunk("eXIf", testExif(binary.BigEndian, 1, true)),
+		testPngChunk("tEXt", []byte("Comment\x00hello")),
+		testPngChunk("iTXt", testXmpGps),
+		testPngChunk("gAMA", []byte{0, 0, 0xB1, 0x8F}))
+
+	stripped, err := stripPngMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pngExif(stripped) != nil || HasGpsLocation(stripped) || bytes.Contains(stripped, []byte("tEXt")) {
+		t.Error("the metadata is kept")
+	}
+	if !bytes.Contains(stripped, []byte("gAMA")) {
+		t.Error("the rendering chunk is removed")
+	}
+	if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("the stripped image is broken: %v", err)
+	}
+
+	_, err = stripPngMetadata(data[:len(data)-1])
+	if err == nil {
+		t.Error("the truncated PNG is stripped")
+	}
+}
+
+func TestProcessImagePngOrientation(t *testing.T) {
+	// The orientation 6 rotates the image by 90 degrees clockwise
+	data := testPng(t, 4, 2, testPngChunk("eXIf", testExif(binary.BigEndian, 6, true)))
+
+	processed, err := ProcessImage(data, ImageProcessingOptions{StripMetadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(processed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 2 || cfg.Height != 4 {
+		t.Errorf("the orientation is not applied: %dx%d", cfg.Width, cfg.Height)
+	}
+	if HasGpsLocation(processed) {
+		t.Error("the GPS location is kept")
+	}
+}
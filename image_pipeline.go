@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJpegQuality is used when a JPEG image has to be re-encoded, but the quality is not specified
+const DefaultJpegQuality = 90
+
+const processedImagesDir = "processed"
+
+// ImageProcessingOptions describes how the JPEG and PNG images are processed before the upload
+type ImageProcessingOptions struct {
+	// MaxDimension downsizes the images to fit into a MaxDimension x MaxDimension box, 0 disables the resizing
+	MaxDimension int
+	// Quality re-encodes the JPEG images with this quality (1-100) and the PNG images with the best
+	// compression, 0 keeps the original encoding
+	Quality int
+	// StripMetadata removes the EXIF (including the GPS location), XMP and IPTC metadata, only the EXIF
+	// orientation is kept
+	StripMetadata bool
+}
+
+func (o ImageProcessingOptions) Enabled() bool {
+	return o.MaxDimension > 0 || o.Quality > 0 || o.StripMetadata
+}
+
+// String identifies the processing in the cached file names, and in the backend name of the image index
+func (o ImageProcessingOptions) String() string {
+	return fmt.Sprintf("max%d-q%d-strip%t", o.MaxDimension, o.Quality, o.StripMetadata)
+}
+
+// ProcessingImageSyncer processes the local images before handing them to the actual image hosting. The
+// processed images are cached by the hash of the original, so the unchanged images are not processed again.
+// The images with the GPS location are reported, whether it's removed or not.
+type ProcessingImageSyncer struct {
+	ImageSyncer
+	cacheDir string
+	opts     ImageProcessingOptions
+
+	// ReadOnly keeps the processed images in memory instead of caching them, it's used for planning. The
+	// images can't be uploaded in this mode.
+	ReadOnly bool
+
+	// reportedGps has the images that have already been reported to have the GPS location
+	reportedGps sync.Map
+}
+
+var _ ImageSyncer = &ProcessingImageSyncer{}
+
+func NewProcessingImageSyncer(syncer ImageSyncer, rootDir string, opts ImageProcessingOptions) *ProcessingImageSyncer {
+	return &ProcessingImageSyncer{
+		ImageSyncer: syncer,
+		cacheDir:    filepath.Join(rootDir, SyncStateDir, processedImagesDir),
+		opts:        opts,
+	}
+}
+
+// Backend differs from the wrapped one, so changing the options uploads the images again
+func (p *ProcessingImageSyncer) Backend() string {
+	return p.ImageSyncer.Backend() + "+" + p.opts.String()
+}
+
+func (p *ProcessingImageSyncer) FindUploadedImage(img LocalImage) (string, bool) {
+	processed, _, err := p.process(img)
+	if err != nil {
+		// The upload is going to report it
+		return "", false
+	}
+	return p.ImageSyncer.FindUploadedImage(processed)
+}
+
+func (p *ProcessingImageSyncer) EnsureLocalImageIsUploaded(ctx context.Context, img LocalImage) (string, error) {
+	processed, err := p.processForUpload(img)
+	if err != nil {
+		return "", err
+	}
+	return p.ImageSyncer.EnsureLocalImageIsUploaded(ctx, processed)
+}
+
+func (p *ProcessingImageSyncer) UploadImage(ctx context.Context, img LocalImage) (string, error) {
+	processed, err := p.processForUpload(img)
+	if err != nil {
+		return "", err
+	}
+	return p.ImageSyncer.UploadImage(ctx, processed)
+}
+
+// processForUpload processes the image and reports the GPS location
+func (p *ProcessingImageSyncer) processForUpload(img LocalImage) (LocalImage, error) {
+	if p.ReadOnly {
+		return img, fmt.Errorf("can't upload the image %s in the read-only mode", img.relPath)
+	}
+	processed, hasGps, err := p.process(img)
+	if err != nil {
+		return img, err
+	}
+	p.reportGps(img, hasGps)
+	return processed, nil
+}
+
+// reportGps logs the image with the GPS location once per run
+func (p *ProcessingImageSyncer) reportGps(img LocalImage, hasGps bool) {
+	if !hasGps {
+		return
+	}
+	if _, reported := p.reportedGps.LoadOrStore(img.relPath, true); reported {
+		return
+	}
+	if p.opts.StripMetadata {
+		slog.Default().Info("The image contains the GPS location, it's removed before the upload",
+			slog.String("path", img.relPath))
+	} else {
+		slog.Default().Warn("The image contains the GPS location, and it's published as is",
+			slog.String("path", img.relPath))
+	}
+}
+
+// process returns the image that points to the processed copy of the file, or the image itself if it
+// doesn't need any processing. It also checks if the original has the GPS location.
+func (p *ProcessingImageSyncer) process(img LocalImage) (LocalImage, bool, error) {
+	if img.mediaType != "image/jpeg" && img.mediaType != "image/png" {
+		return img, false, nil
+	}
+	ext := strings.ToLower(path.Ext(img.relPath))
+
+	data, err := os.ReadFile(img.fullPath)
+	if err != nil {
+		return img, false, err
+	}
+	hasGps := HasGpsLocation(data)
+	if !p.opts.Enabled() {
+		return img, hasGps, nil
+	}
+
+	hash := sha256.Sum256(data)
+	cached := filepath.Join(p.cacheDir, hex.EncodeToString(hash[:])+"-"+p.opts.String()+ext)
+
+	stat, err := os.Stat(cached)
+	if errors.Is(err, os.ErrNotExist) {
+		var processed []byte
+		processed, err = ProcessImage(data, p.opts)
+		if err != nil {
+			return img, hasGps, fmt.Errorf("failed to process the image %s: %w", img.relPath, err)
+		}
+		if processed == nil {
+			return img, hasGps, nil
+		}
+
+		if p.ReadOnly {
+			img.fullPath = cached
+			img.size = int64(len(processed))
+			img.data = processed
+			return img, hasGps, nil
+		}
+
+		slog.Default().Info("Processed the image", slog.String("path", img.relPath),
+			slog.Int("size", len(data)), slog.Int("processed_size", len(processed)))
+		err = WriteFileAtomically(cached, 0644, time.Time{}, func(w io.Writer) error {
+			_, err := w.Write(processed)
+			return err
+		})
+		if err != nil {
+			return img, hasGps, err
+		}
+		stat, err = os.Stat(cached)
+	}
+	if err != nil {
+		return img, hasGps, err
+	}
+
+	// The remote name stays the same, and the mtime is the original's, so the hosting can compare it
+	img.fullPath = cached
+	img.size = stat.Size()
+	return img, hasGps, nil
+}
+
+// ProcessImage resizes, re-encodes and strips the JPEG or PNG image according to the options. The result
+// is nil if the image doesn't need to be changed.
+func ProcessImage(data []byte, opts ImageProcessingOptions) ([]byte, error) {
+	isJpeg := !bytes.HasPrefix(data, pngSignature)
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var orientation int
+	if isJpeg {
+		orientation = exifOrientation(jpegExif(data))
+	} else {
+		orientation = exifOrientation(pngExif(data))
+	}
+
+	resize := opts.MaxDimension > 0 && max(cfg.Width, cfg.Height) > opts.MaxDimension
+	if !resize && opts.Quality == 0 {
+		if !opts.StripMetadata {
+			return nil, nil
+		}
+		if isJpeg {
+			return stripJpegMetadata(data)
+		}
+		// The PNG orientation lives in the stripped eXIf chunk, so the rotated image is re-encoded
+		if orientation == 1 {
+			return stripPngMetadata(data)
+		}
+	}
+
+	// The re-encoding drops the metadata, so the orientation is applied to the pixels
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img = applyOrientation(img, orientation)
+	if resize {
+		img = resizeToFit(img, opts.MaxDimension)
+	}
+
+	var buf bytes.Buffer
+	if isJpeg {
+		quality := opts.Quality
+		if quality == 0 {
+			quality = DefaultJpegQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeToFit downsizes the image to fit into a maxDim x maxDim box, keeping its aspect ratio
+func resizeToFit(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w >= h {
+		h = max(1, h*maxDim/w)
+		w = maxDim
+	} else {
+		w = max(1, w*maxDim/h)
+		h = maxDim
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// applyOrientation transforms the image according to the EXIF orientation, so it's displayed correctly
+// without the metadata
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // Rotated by 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // Transposed
+				sx, sy = y, x
+			case 6: // Rotated by 90 counter-clockwise, so it has to be rotated clockwise
+				sx, sy = y, h-1-x
+			case 7: // Transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // Rotated by 90 clockwise, so it has to be rotated counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessingImageSyncerUpload(t *testing.T) {
+	rootDir := t.TempDir()
+	imageDir := t.TempDir()
+	fullPath := filepath.Join(rootDir, "img/a.png")
+	writeTestImage(t, fullPath)
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := LocalImage{fullPath: fullPath, relPath: "img/a.png", mediaType: "image/png",
+		size: stat.Size(), mtime: stat.ModTime()}
+
+	syncer := NewProcessingImageSyncer(NewFilesystemSync(rootDir, imageDir, testImageUrlRoot), rootDir,
+		ImageProcessingOptions{MaxDimension: 1})
+	imgUrl, err := syncer.UploadImage(context.Background(), img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imgUrl != testImageUrlRoot+"/img/a.png" {
+		t.Errorf("unexpected URL: %s", imgUrl)
+	}
+
+	// The processed copy is published, not the original
+	published, err := os.Stat(filepath.Join(imageDir, "img/a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published.Size() == stat.Size() {
+		t.Error("the published image is not processed")
+	}
+}
+
+func TestProcessingImageSyncerReadOnly(t *testing.T) {
+	rootDir := t.TempDir()
+	imageDir := t.TempDir()
+	fullPath := filepath.Join(rootDir, "img/a.png")
+	writeTestImage(t, fullPath)
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := LocalImage{fullPath: fullPath, relPath: "img/a.png", mediaType: "image/png",
+		size: stat.Size(), mtime: stat.ModTime()}
+	opts := ImageProcessingOptions{MaxDimension: 1}
+	ctx := context.Background()
+
+	_, err = NewProcessingImageSyncer(NewFilesystemSync(rootDir, imageDir, testImageUrlRoot), rootDir, opts).
+		UploadImage(ctx, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(rootDir, SyncStateDir, processedImagesDir)
+	err = os.RemoveAll(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosting := NewFilesystemSync(rootDir, imageDir, testImageUrlRoot)
+	err = hosting.BuildImageMap(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer := NewProcessingImageSyncer(hosting, rootDir, opts)
+	syncer.ReadOnly = true
+
+	// The processed copy is compared with the published one without caching it
+	imgUrl, ok := syncer.FindUploadedImage(img)
+	if !ok || imgUrl != testImageUrlRoot+"/img/a.png" {
+		t.Errorf("the processed image is not found: %q", imgUrl)
+	}
+	if _, err := os.Stat(cacheDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the processed image is cached in the read-only mode: %v", err)
+	}
+	_, err = syncer.UploadImage(ctx, img)
+	if err == nil {
+		t.Error("the image is uploaded in the read-only mode")
+	}
+}
@@ -1,27 +1,48 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gomarkdown/markdown"
 	"github.com/gomarkdown/markdown/ast"
 	"github.com/gomarkdown/markdown/md"
-	"github.com/gomarkdown/markdown/parser"
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
+	"time"
 )
 
 type ImageSyncer interface {
-	BuildImageMap() error
-	EnsureLocalImageIsUploaded(img LocalImage) (string, error)
-	DownloadAndSaveImage(fullImageUrl string, postDatePart string, postSlug string) (string, error)
+	BuildImageMap(ctx context.Context) error
+	// FindUploadedImage returns the URL of the local image if it's already uploaded and up-to-date
+	FindUploadedImage(img LocalImage) (string, bool)
+	EnsureLocalImageIsUploaded(ctx context.Context, img LocalImage) (string, error)
+	// UploadImage uploads the image even if there's already an image with the same path, it's used to
+	// upload the changed images
+	UploadImage(ctx context.Context, img LocalImage) (string, error)
+	// Backend identifies the image hosting in the image index
+	Backend() string
+	// SupportsMediaType checks if the image hosting can store the files of this MIME type
+	SupportsMediaType(mediaType string) bool
+	// HostedImages lists the images on the image hosting, as of the last BuildImageMap
+	HostedImages() []HostedImage
+	// DeleteHostedImage removes the image from the image hosting
+	DeleteHostedImage(ctx context.Context, img HostedImage) error
+	// PlanImageDownload returns the local path for the remote image, and whether it needs to be downloaded.
+	// The path is empty for the images that are not managed by this syncer.
+	PlanImageDownload(fullImageUrl string, postDatePart string, postSlug string) (string, bool, error)
+	DownloadAndSaveImage(ctx context.Context, fullImageUrl string, postDatePart string, postSlug string) (string, error)
 }
 
-func IsImageFile(fileName string) bool {
-	ext := strings.ToLower(filepath.Ext(fileName))
-	return ext == ".png" || ext == ".jpg" || ext == ".jpeg" || ext == ".gif" || ext == ".svg"
+// HostedImage is an image stored on the image hosting
+type HostedImage struct {
+	Url string
+	// Name is the path of the image relative to the blog root, if it's known
+	Name    string
+	Created time.Time
+
+	id string
 }
 
 // EnsurePathIsRelativeToItsLocation Make sure that the `filePath` is a relative path that
@@ -48,69 +69,106 @@ func EnsurePathIsRelativeToItsLocation(filePath string, absOk bool) (string, err
 		if dir == "" {
 			break
 		}
-		curPath = file
+		curPath = strings.TrimSuffix(dir, "/")
 	}
 
 	return filePath, nil
 }
 
-func GatherPostImagesAndTitle(rootDir string, input []byte) ([]LocalImage, string, error) {
-	extensions := parser.CommonExtensions
-	mdParser := parser.NewWithExtensions(extensions)
-	doc := mdParser.Parse(input)
+// resolveLocalReference finds the local media file referenced by the post located in `postDir` (relative to
+// the `rootDir`). The Obsidian embeds are looked up relative to the root as well, if they're not found next
+// to the post. It returns an empty image if the reference is not a local media file.
+func resolveLocalReference(rootDir string, postDir string, ref MediaRef) (LocalImage, error) {
+	// Skip absolute URLs (with the schema), and the links within the page
+	imgUrl, err := url.Parse(ref.Dest)
+	if err != nil || imgUrl.IsAbs() || imgUrl.Path == "" {
+		return LocalImage{}, nil
+	}
+	dst := path.Clean(ref.Dest)
+
+	// The paths going up from a nested post are resolved against the post directory, they're fine as long as
+	// they stay within the blog root
+	dir := postDir
+	if postDir != "" && strings.HasPrefix(dst, "../") {
+		dst = path.Join(postDir, dst)
+		dir = ""
+	}
+
+	// On reflection, we shouldn't allow using absolute paths to files in posts, as it might be a vector
+	// for an attacker to read arbitrary files from the author's computer. The links to the files
+	// that don't look like the media files are not ours to check, though.
+	imgPath, err := EnsurePathIsRelativeToItsLocation(dst, false)
+	if err != nil {
+		if !IsMediaFile(ref.Dest) {
+			return LocalImage{}, nil
+		}
+		return LocalImage{}, err
+	}
+	if imgPath == "" {
+		return LocalImage{}, nil
+	}
+
+	// The image path is relative to the post, but the images are identified by their paths
+	// relative to the blog root. Keep the raw path for the posts in the root, for compatibility.
+	relPath := ref.Dest
+	if postDir != "" {
+		relPath = path.Join(dir, imgPath)
+	}
+	fullPath := path.Join(rootDir, dir, imgPath)
+
+	st, statErr := os.Stat(fullPath)
+	if statErr != nil && ref.Embed && dir != "" {
+		relPath = imgPath
+		fullPath = path.Join(rootDir, imgPath)
+		st, statErr = os.Stat(fullPath)
+	}
+	if statErr != nil || !st.Mode().IsRegular() {
+		return LocalImage{}, nil
+	}
+
+	// Path exists! Check that it's one of the synchronized media files by its contents.
+	mediaType, err := LocalMediaType(fullPath)
+	if err != nil || mediaType == "" {
+		return LocalImage{}, err
+	}
+	return LocalImage{
+		fullPath:  fullPath,
+		relPath:   relPath,
+		ref:       ref.Dest,
+		embed:     ref.Embed,
+		mediaType: mediaType,
+		size:      st.Size(),
+		mtime:     st.ModTime(),
+	}, nil
+}
+
+// GatherPostImagesAndTitle finds the local images and other media files (linked or embedded) referenced by
+// the post located in `postDir` (relative to the `rootDir`), and extracts the post title.
+func GatherPostImagesAndTitle(rootDir string, postDir string, input []byte) ([]LocalImage, string, error) {
+	doc := parseMarkdown(input)
 
 	// Collect the local images
 	var images []LocalImage
 	var err error
 	var title string
 	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
 		// Extract the document title (the first first-level header)
-		if head, ok := node.(*ast.Heading); ok && entering && title == "" {
+		if head, ok := node.(*ast.Heading); ok && title == "" {
 			mdr := md.NewRenderer()
 			title = string(markdown.Render(head, mdr))
 			title = strings.TrimSpace(strings.TrimPrefix(title, "#"))
 		}
-		if img, ok := node.(*ast.Image); ok && entering {
-			// Check if image is relative to the post
-			rawDst := string(img.Destination)
-
-			// Skip non-image file
-			if !IsImageFile(rawDst) {
-				return ast.GoToNext
-			}
-
-			// Skip absolute URLs (with the schema)
-			var imgUrl *url.URL
-			imgUrl, err = url.Parse(rawDst)
-			if imgUrl.IsAbs() {
-				return ast.GoToNext
-			}
-			dst := path.Clean(rawDst)
-
-			var imgPath string
-			// On reflection, we shouldn't allow using absolute paths to files in posts, as it might be a vector
-			// for an attacker to read arbitrary files from the author's computer.
-			imgPath, err = EnsurePathIsRelativeToItsLocation(dst, false)
+		for _, ref := range nodeReferences(node) {
+			var img LocalImage
+			img, err = resolveLocalReference(rootDir, postDir, ref)
 			if err != nil {
 				return ast.Terminate
 			}
-			if imgPath == "" {
-				return ast.GoToNext
-			}
-
-			if !path.IsAbs(imgPath) {
-				imgPath = path.Join(rootDir, imgPath)
-			}
-
-			st, statErr := os.Stat(imgPath)
-			if statErr == nil {
-				// Path exists!
-				images = append(images, LocalImage{
-					fullPath: imgPath,
-					relPath:  rawDst,
-					size:     st.Size(),
-					mtime:    st.ModTime(),
-				})
+			if img.fullPath != "" {
+				images = append(images, img)
 			}
 		}
 		return ast.GoToNext
@@ -122,36 +180,30 @@ func GatherPostImagesAndTitle(rootDir string, input []byte) ([]LocalImage, strin
 	return images, title, nil
 }
 
-func ParsePostAndDownloadReferencedImages(syncer ImageSyncer,
-	postContent string, datePart, slug string) (map[string]string, error) {
+// FindReferencedImages returns the destinations of all the images and the linked media files in the post
+func FindReferencedImages(postContent string) []string {
+	var res []string
+	for _, ref := range FindMediaReferences([]byte(postContent)) {
+		// Skip the files that are not synchronized
+		if IsMediaFile(ref.Dest) {
+			res = append(res, ref.Dest)
+		}
+	}
+	return res
+}
 
-	extensions := parser.CommonExtensions
-	mdParser := parser.NewWithExtensions(extensions)
-	doc := mdParser.Parse([]byte(postContent))
+func ParsePostAndDownloadReferencedImages(ctx context.Context, syncer ImageSyncer,
+	postContent string, datePart, slug string) (map[string]string, error) {
 
-	// Download
-	var err error
 	linkFixMap := make(map[string]string)
-	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
-		if img, ok := node.(*ast.Image); ok && entering {
-			// Skip non-image file
-			if !IsImageFile(string(img.Destination)) {
-				return ast.GoToNext
-			}
-
-			var newDest string
-			newDest, err = syncer.DownloadAndSaveImage(string(img.Destination), datePart, slug)
-			if err != nil {
-				return ast.Terminate
-			}
-			if newDest != "" {
-				linkFixMap[string(img.Destination)] = newDest
-			}
+	for _, dest := range FindReferencedImages(postContent) {
+		newDest, err := syncer.DownloadAndSaveImage(ctx, dest, datePart, slug)
+		if err != nil {
+			return nil, err
+		}
+		if newDest != "" {
+			linkFixMap[dest] = newDest
 		}
-		return ast.GoToNext
-	})
-	if err != nil {
-		return nil, err
 	}
 
 	return linkFixMap, nil
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveLocalReferenceNested(t *testing.T) {
+	rootDir := t.TempDir()
+	writeTestImage(t, filepath.Join(rootDir, "notes/images/a.png"))
+	writeTestImage(t, filepath.Join(rootDir, "images/b.png"))
+	writeTestImage(t, filepath.Join(rootDir, "notes/2024/c.png"))
+
+	tests := []struct {
+		dest    string
+		want    string
+		wantErr bool
+	}{
+		{dest: "c.png", want: "notes/2024/c.png"},
+		{dest: "./c.png", want: "notes/2024/c.png"},
+		{dest: "../images/a.png", want: "notes/images/a.png"},
+		{dest: "../../images/b.png", want: "images/b.png"},
+		{dest: "../missing.png"},
+		{dest: "../../../outside.png", wantErr: true},
+		{dest: "/images/b.png", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dest, func(t *testing.T) {
+			img, err := resolveLocalReference(rootDir, "notes/2024", MediaRef{Dest: tt.dest})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if img.relPath != tt.want {
+				t.Errorf("got %q, want %q", img.relPath, tt.want)
+			}
+			if tt.want != "" && img.fullPath != filepath.Join(rootDir, tt.want) {
+				t.Errorf("unexpected full path: %s", img.fullPath)
+			}
+		})
+	}
+}
+
+func TestEnsurePathIsRelativeToItsLocation(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{path: "a.png"},
+		{path: "img/2024/a.png"},
+		{path: "../a.png", wantErr: true},
+		{path: "img/../../a.png", wantErr: true},
+		{path: "img/./a.png", wantErr: true},
+		{path: "/img/a.png", wantErr: true},
+		{path: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := EnsurePathIsRelativeToItsLocation(tt.path, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultMediaTypes are the extensions of the files that are synchronized along with the posts
+var DefaultMediaTypes = []string{"png", "jpg", "jpeg", "gif", "svg", "webp", "avif", "heic", "pdf", "mp3", "mp4"}
+
+// knownMediaTypes maps the sniffed MIME types to their extensions
+var knownMediaTypes = map[string]string{
+	"image/png":       "png",
+	"image/jpeg":      "jpg",
+	"image/gif":       "gif",
+	"image/svg+xml":   "svg",
+	"image/webp":      "webp",
+	"image/avif":      "avif",
+	"image/heic":      "heic",
+	"application/pdf": "pdf",
+	"audio/mpeg":      "mp3",
+	"audio/ogg":       "ogg",
+	"audio/wave":      "wav",
+	"video/mp4":       "mp4",
+	"video/webm":      "webm",
+}
+
+// mediaExtensions is the configured set of the synchronized file extensions
+var mediaExtensions = makeMediaExtensions(DefaultMediaTypes)
+
+func makeMediaExtensions(types []string) map[string]bool {
+	res := make(map[string]bool)
+	for _, t := range types {
+		ext := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), "."))
+		res[ext] = true
+		// The JPEG files have two common extensions
+		if ext == "jpg" || ext == "jpeg" {
+			res["jpg"] = true
+			res["jpeg"] = true
+		}
+	}
+	return res
+}
+
+// SetMediaTypes configures the extensions of the synchronized files
+func SetMediaTypes(types []string) error {
+	for _, t := range types {
+		if strings.Trim(t, ". ") == "" || strings.ContainsAny(t, "/\\") {
+			return fmt.Errorf("invalid media type: %q", t)
+		}
+	}
+	mediaExtensions = makeMediaExtensions(types)
+	return nil
+}
+
+// IsMediaFile checks if the file (or URL) has one of the synchronized extensions
+func IsMediaFile(fileName string) bool {
+	return mediaExtensions[strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))]
+}
+
+// DetectMediaType sniffs the MIME type of the file from its contents
+func DetectMediaType(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	// The ISO media files (AVIF and HEIC images) are identified by the brand of their "ftyp" box
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "avif", "avis":
+			return "image/avif", nil
+		case "heic", "heix", "heim", "heis", "mif1", "msf1":
+			return "image/heic", nil
+		}
+	}
+
+	contentType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	if (strings.HasPrefix(contentType, "text/") && contentType != "text/html") && bytes.Contains(head, []byte("<svg")) {
+		return "image/svg+xml", nil
+	}
+	return contentType, nil
+}
+
+// LocalMediaType determines the type of the local file by its contents, falling back to its extension if
+// the contents are not recognized. The type is empty if the file is not one of the synchronized media files.
+func LocalMediaType(fileName string) (string, error) {
+	contentType, err := DetectMediaType(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	if ext, ok := knownMediaTypes[contentType]; ok {
+		if !mediaExtensions[ext] {
+			return "", nil
+		}
+		return contentType, nil
+	}
+
+	if !IsMediaFile(fileName) {
+		return "", nil
+	}
+	if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(fileName))); byExt != "" {
+		contentType, _, _ = strings.Cut(byExt, ";")
+	}
+	return contentType, nil
+}
+
+// isWebImage checks if the media type is one of the images supported by all the browsers
+func isWebImage(mediaType string) bool {
+	return mediaType == "image/png" || mediaType == "image/jpeg" || mediaType == "image/gif"
+}
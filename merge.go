@@ -0,0 +1,160 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	ConflictMarkerLocal     = "<<<<<<< local"
+	ConflictMarkerSeparator = "======="
+	ConflictMarkerRemote    = ">>>>>>> remote"
+)
+
+// HasConflictMarkers checks if the content still has an unresolved conflict: the local, the separator and the
+// remote markers in this order. A lone "=======" line is a setext heading underline, not a conflict.
+func HasConflictMarkers(content string) bool {
+	expected := []string{ConflictMarkerLocal, ConflictMarkerSeparator, ConflictMarkerRemote}
+	next := 0
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		switch {
+		case line == ConflictMarkerLocal:
+			// A new conflict starts, the previous markers were not a complete one
+			next = 1
+		case next > 0 && line == expected[next]:
+			next++
+			if next == len(expected) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitLines splits the text into lines, keeping the line terminators
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.SplitAfter(text, "\n")
+}
+
+// matchLines finds the longest common subsequence of lines, and returns the mapping from
+// the indices in `a` to the indices of the matching lines in `b`.
+func matchLines(a, b []string) map[int]int {
+	res := make(map[int]int)
+
+	// Strip the common prefix and suffix, posts are usually mostly the same
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		res[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		res[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	midA := a[prefix : len(a)-suffix]
+	midB := b[prefix : len(b)-suffix]
+
+	// Classic dynamic programming LCS, lcs[i][j] is the LCS length of midA[i:] and midB[j:]
+	lcs := make([][]int, len(midA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(midB)+1)
+	}
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	for i, j := 0, 0; i < len(midA) && j < len(midB); {
+		if midA[i] == midB[j] {
+			res[prefix+i] = prefix + j
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	return res
+}
+
+// Merge3 performs a line-based three-way merge of the local and remote versions of the text
+// that have been derived from the common base. Conflicting chunks are surrounded by Git-style
+// conflict markers, and the second return value is set to true if there were any.
+func Merge3(base, local, remote string) (string, bool) {
+	baseLines := splitLines(base)
+	localLines := splitLines(local)
+	remoteLines := splitLines(remote)
+
+	localMatches := matchLines(baseLines, localLines)
+	remoteMatches := matchLines(baseLines, remoteLines)
+
+	var res strings.Builder
+	hasConflicts := false
+
+	resolveChunk := func(baseChunk, localChunk, remoteChunk []string) {
+		if slices.Equal(localChunk, baseChunk) {
+			res.WriteString(strings.Join(remoteChunk, ""))
+		} else if slices.Equal(remoteChunk, baseChunk) || slices.Equal(localChunk, remoteChunk) {
+			res.WriteString(strings.Join(localChunk, ""))
+		} else {
+			hasConflicts = true
+			res.WriteString(ConflictMarkerLocal + "\n")
+			res.WriteString(terminateLastLine(localChunk))
+			res.WriteString(ConflictMarkerSeparator + "\n")
+			res.WriteString(terminateLastLine(remoteChunk))
+			res.WriteString(ConflictMarkerRemote + "\n")
+		}
+	}
+
+	i, j, k := 0, 0, 0
+	for {
+		// Find the next base line that is unchanged on both sides
+		stable := -1
+		for o := i; o < len(baseLines); o++ {
+			_, inLocal := localMatches[o]
+			_, inRemote := remoteMatches[o]
+			if inLocal && inRemote {
+				stable = o
+				break
+			}
+		}
+
+		if stable == -1 {
+			resolveChunk(baseLines[i:], localLines[j:], remoteLines[k:])
+			break
+		}
+
+		lj, rk := localMatches[stable], remoteMatches[stable]
+		if stable == i && lj == j && rk == k {
+			res.WriteString(baseLines[i])
+			i, j, k = i+1, j+1, k+1
+			continue
+		}
+
+		resolveChunk(baseLines[i:stable], localLines[j:lj], remoteLines[k:rk])
+		i, j, k = stable, lj, rk
+	}
+
+	return res.String(), hasConflicts
+}
+
+func terminateLastLine(lines []string) string {
+	text := strings.Join(lines, "")
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text
+}
@@ -0,0 +1,102 @@
+package main
+
+import "testing"
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name                string
+		base, local, remote string
+		want                string
+		conflicts           bool
+	}{
+		{
+			name: "unchanged",
+			base: "a\nb\nc\n", local: "a\nb\nc\n", remote: "a\nb\nc\n",
+			want: "a\nb\nc\n",
+		},
+		{
+			name: "local change only",
+			base: "a\nb\nc\n", local: "a\nB\nc\n", remote: "a\nb\nc\n",
+			want: "a\nB\nc\n",
+		},
+		{
+			name: "remote change only",
+			base: "a\nb\nc\n", local: "a\nb\nc\n", remote: "a\nb\nC\n",
+			want: "a\nb\nC\n",
+		},
+		{
+			name: "non-overlapping changes",
+			base: "a\nb\nc\nd\n", local: "A\nb\nc\nd\n", remote: "a\nb\nc\nD\n",
+			want: "A\nb\nc\nD\n",
+		},
+		{
+			name: "same change on both sides",
+			base: "a\nb\nc\n", local: "a\nX\nc\n", remote: "a\nX\nc\n",
+			want: "a\nX\nc\n",
+		},
+		{
+			name: "insertions on both sides",
+			base: "a\nc\n", local: "a\nb\nc\n", remote: "a\nc\nd\n",
+			want: "a\nb\nc\nd\n",
+		},
+		{
+			name: "deletion and an unrelated edit",
+			base: "a\nb\nc\nd\n", local: "a\nc\nd\n", remote: "a\nb\nc\nD\n",
+			want: "a\nc\nD\n",
+		},
+		{
+			name: "conflicting edits",
+			base: "a\nb\nc\n", local: "a\nL\nc\n", remote: "a\nR\nc\n",
+			want:      "a\n<<<<<<< local\nL\n=======\nR\n>>>>>>> remote\nc\n",
+			conflicts: true,
+		},
+		{
+			name: "conflict on the last line without a newline",
+			base: "a\nb", local: "a\nL", remote: "a\nR",
+			want:      "a\n<<<<<<< local\nL\n=======\nR\n>>>>>>> remote\n",
+			conflicts: true,
+		},
+		{
+			name: "empty base",
+			base: "", local: "a\n", remote: "a\n",
+			want: "a\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicts := Merge3(tt.base, tt.local, tt.remote)
+			if got != tt.want || conflicts != tt.conflicts {
+				t.Errorf("Merge3() = %q, %v; want %q, %v", got, conflicts, tt.want, tt.conflicts)
+			}
+			if HasConflictMarkers(got) != tt.conflicts {
+				t.Errorf("HasConflictMarkers(%q) = %v", got, !tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestHasConflictMarkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"no markers", "# Title\n\nText\n", false},
+		{"setext heading", "Title\n=======\n\nText\n", false},
+		{"full conflict", "<<<<<<< local\na\n=======\nb\n>>>>>>> remote\n", true},
+		{"windows line endings", "<<<<<<< local\r\na\r\n=======\r\nb\r\n>>>>>>> remote\r\n", true},
+		{"markers out of order", "=======\n<<<<<<< local\n>>>>>>> remote\n", false},
+		{"resolved except the start marker", "<<<<<<< local\na\nb\n", false},
+		{"heading before the conflict", "Title\n=======\n<<<<<<< local\na\n=======\nb\n>>>>>>> remote\n", true},
+		{"separator in the text", "see:\n\n    =======\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HasConflictMarkers(tt.content); got != tt.want {
+				t.Errorf("HasConflictMarkers(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultJobs is the default number of the parallel image transfers
+const DefaultJobs = 4
+
+// RunParallel calls f for each of the n items, using at most `jobs` goroutines. The first error cancels the
+// context passed to the other calls, and it's returned once all the started calls are finished.
+func RunParallel(ctx context.Context, jobs, n int, f func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstErr error
+	var once sync.Once
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(max(jobs, 1), n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				err := f(ctx, i)
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunParallel(t *testing.T) {
+	tests := []struct {
+		jobs, n, wantMax int
+	}{
+		{jobs: 3, n: 20, wantMax: 3},
+		{jobs: 0, n: 5, wantMax: 1},
+		{jobs: 8, n: 2, wantMax: 2},
+		{jobs: 2, n: 0},
+	}
+	for _, tt := range tests {
+		var active, maxActive atomic.Int32
+		done := make([]atomic.Int32, tt.n)
+		err := RunParallel(context.Background(), tt.jobs, tt.n, func(ctx context.Context, i int) error {
+			cur := active.Add(1)
+			defer active.Add(-1)
+			for {
+				old := maxActive.Load()
+				if cur <= old || maxActive.CompareAndSwap(old, cur) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			done[i].Add(1)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range done {
+			if done[i].Load() != 1 {
+				t.Errorf("jobs=%d: the item %d is processed %d times", tt.jobs, i, done[i].Load())
+			}
+		}
+		if int(maxActive.Load()) > tt.wantMax {
+			t.Errorf("jobs=%d: %d calls at once, want at most %d", tt.jobs, maxActive.Load(), tt.wantMax)
+		}
+	}
+}
+
+func TestRunParallelError(t *testing.T) {
+	errFailed := errors.New("failed")
+	var started atomic.Int32
+	err := RunParallel(context.Background(), 2, 100, func(ctx context.Context, i int) error {
+		started.Add(1)
+		if i == 0 {
+			return errFailed
+		}
+		// The other calls wait for the cancellation
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("the first error is not returned: %v", err)
+	}
+	if started.Load() >= 100 {
+		t.Error("the items are still processed after the error")
+	}
+}
+
+func TestRunParallelCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var started atomic.Int32
+	err := RunParallel(ctx, 2, 100, func(ctx context.Context, i int) error {
+		if started.Add(1) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("the cancellation is not returned: %v", err)
+	}
+	if started.Load() >= 100 {
+		t.Error("the items are still processed after the cancellation")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// IgnoreFileName is the gitignore-like file in the blog root that lists the paths to skip
+const IgnoreFileName = ".writeas-syncignore"
+
+// DefaultExcludes are never considered to be posts
+var DefaultExcludes = []string{".*", ArchiveDir}
+
+// PathFilter decides which files and directories are scanned for posts
+type PathFilter struct {
+	include []*regexp.Regexp
+	exclude []excludeRule
+}
+
+// excludeRule is an exclude glob, the negated ones (`!glob`) re-include the paths excluded by the previous rules
+type excludeRule struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
+// LoadPathFilter creates the filter from the include and exclude globs, the patterns from the ignore file in
+// the blog root and the default excludes. The default excludes go last, so they can't be negated.
+func LoadPathFilter(rootDir string, include, exclude []string) (*PathFilter, error) {
+	ignored, err := readIgnoreFile(path.Join(rootDir, IgnoreFileName))
+	if err != nil {
+		return nil, err
+	}
+	excludes := append(slices.Clone(exclude), ignored...)
+	excludes = append(excludes, DefaultExcludes...)
+
+	res := &PathFilter{}
+	for _, g := range include {
+		re, err := GlobToRegexp(g)
+		if err != nil {
+			return nil, err
+		}
+		res.include = append(res.include, re)
+	}
+	for _, g := range excludes {
+		negate := strings.HasPrefix(g, "!")
+		re, err := GlobToRegexp(strings.TrimPrefix(g, "!"))
+		if err != nil {
+			return nil, err
+		}
+		res.exclude = append(res.exclude, excludeRule{re: re, negate: negate})
+	}
+
+	return res, nil
+}
+
+func readIgnoreFile(fileName string) ([]string, error) {
+	file, err := os.Open(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	var res []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res = append(res, line)
+	}
+
+	return res, scanner.Err()
+}
+
+// IsExcluded checks if the file or the directory (relative to the blog root) must be skipped, the last
+// matching rule wins
+func (f *PathFilter) IsExcluded(relPath string) bool {
+	excluded := false
+	for _, rule := range f.exclude {
+		if rule.re.MatchString(relPath) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+// IsIncluded checks if the file (relative to the blog root) matches the include globs, if there are any
+func (f *PathFilter) IsIncluded(relPath string) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFiltered checks if the post discovery skips the file (relative to the blog root), either by itself or
+// because it's in an excluded directory
+func (f *PathFilter) IsFiltered(relPath string) bool {
+	for dir := path.Dir(relPath); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if f.IsExcluded(dir) {
+			return true
+		}
+	}
+	return f.IsExcluded(relPath) || !f.IsIncluded(relPath)
+}
+
+// GlobToRegexp converts a slash-separated glob into a regular expression. The `**` matches any number of
+// directories, and the patterns without slashes match the names at any directory level (like in .gitignore).
+// A backslash escapes the next character.
+func GlobToRegexp(glob string) (*regexp.Regexp, error) {
+	glob = strings.TrimSuffix(glob, "/")
+	if strings.HasPrefix(glob, "/") {
+		glob = strings.TrimPrefix(glob, "/")
+	} else if !strings.Contains(glob, "/") {
+		glob = "**/" + glob
+	}
+
+	var res strings.Builder
+	res.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			res.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			res.WriteString(".*")
+			i++
+		case c == '*':
+			res.WriteString("[^/]*")
+		case c == '?':
+			res.WriteString("[^/]")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			res.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			res.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	res.WriteString("$")
+
+	return regexp.Compile(res.String())
+}
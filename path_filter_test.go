@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/writeas/go-writeas/v2"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{glob: "*.md", path: "a.md", match: true},
+		{glob: "*.md", path: "dir/a.md", match: true},
+		{glob: "*.md", path: "a.mdx"},
+		{glob: "drafts/*.md", path: "drafts/a.md", match: true},
+		{glob: "drafts/*.md", path: "drafts/sub/a.md"},
+		{glob: "drafts/*.md", path: "blog/drafts/a.md"},
+		{glob: "drafts/**/*.md", path: "drafts/a.md", match: true},
+		{glob: "drafts/**/*.md", path: "drafts/x/y/a.md", match: true},
+		{glob: "**/old-*.md", path: "old-1.md", match: true},
+		{glob: "**/old-*.md", path: "a/b/old-1.md", match: true},
+		{glob: "docs/**", path: "docs/a/b.md", match: true},
+		{glob: "/top.md", path: "top.md", match: true},
+		{glob: "/top.md", path: "dir/top.md"},
+		{glob: "scratch/", path: "scratch", match: true},
+		{glob: "scratch/", path: "dir/scratch", match: true},
+		{glob: "?.md", path: "a.md", match: true},
+		{glob: "?.md", path: "ab.md"},
+		{glob: "a?b.md", path: "a/b.md"},
+		{glob: "a+b (1).md", path: "a+b (1).md", match: true},
+		{glob: "a+b (1).md", path: "aab (1).md"},
+		{glob: `\*.md`, path: "*.md", match: true},
+		{glob: `\*.md`, path: "a.md"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.glob+" "+tt.path, func(t *testing.T) {
+			re, err := GlobToRegexp(tt.glob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if re.MatchString(tt.path) != tt.match {
+				t.Errorf("%s: got %t, want %t", re, !tt.match, tt.match)
+			}
+		})
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	rootDir := t.TempDir()
+	ignore := "# Work in progress\nscratch/\n*.tmp.md\n!keep.tmp.md\nprivate/\n!private/public.md\n!.hidden.md\n"
+	err := os.WriteFile(filepath.Join(rootDir, IgnoreFileName), []byte(ignore), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := LoadPathFilter(rootDir, nil, []string{"old/**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	included, err := LoadPathFilter(rootDir, []string{"2024/**"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter   *PathFilter
+		path     string
+		filtered bool
+	}{
+		{filter: filter, path: "2024-01-02-post.md"},
+		{filter: filter, path: "scratch/2024-01-02-post.md", filtered: true},
+		{filter: filter, path: "2024-01-02-post.tmp.md", filtered: true},
+		{filter: filter, path: "keep.tmp.md"},
+		{filter: filter, path: "sub/keep.tmp.md"},
+		// The files can't be re-included from the excluded directories, like in .gitignore
+		{filter: filter, path: "private/public.md", filtered: true},
+		// The default excludes can't be negated
+		{filter: filter, path: ".hidden.md", filtered: true},
+		{filter: filter, path: "_archive/2024-01-02-post.md", filtered: true},
+		{filter: filter, path: "old/2023/2023-01-02-post.md", filtered: true},
+		{filter: included, path: "2024/03/2024-03-02-post.md"},
+		{filter: included, path: "2023-01-02-post.md", filtered: true},
+		{filter: included, path: "2024/scratch/2024-03-02-post.md", filtered: true},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.IsFiltered(tt.path); got != tt.filtered {
+			t.Errorf("%s: got %t, want %t", tt.path, got, tt.filtered)
+		}
+	}
+}
+
+func TestNewPostFileName(t *testing.T) {
+	published := writeas.Post{Slug: "hello", Created: time.Date(2024, 1, 2, 23, 30, 0, 0, time.UTC),
+		Collection: &writeas.Collection{Alias: "blog"}}
+	draft := published
+	draft.Collection = nil
+
+	tests := []struct {
+		name    string
+		layout  string
+		post    writeas.Post
+		want    string
+		wantErr bool
+	}{
+		{name: "default", post: published, want: "2024-01-02-hello.md"},
+		{name: "year", layout: "{{.Year}}/{{.Date}}-{{.Slug}}.md", post: published, want: "2024/2024-01-02-hello.md"},
+		{name: "month", layout: "{{.Year}}/{{.Month}}/{{.Year}}-{{.Month}}-{{.Day}}-{{.Slug}}.md", post: published,
+			want: "2024/01/2024-01-02-hello.md"},
+		{name: "draft", post: draft, want: "drafts/2024-01-02-hello.md"},
+		{name: "draft with layout", layout: "{{.Year}}/{{.Date}}-{{.Slug}}.md", post: draft,
+			want: "drafts/2024/2024-01-02-hello.md"},
+		{name: "no date", layout: "{{.Slug}}.md", post: published, wantErr: true},
+		{name: "outside the root", layout: "../{{.Date}}-{{.Slug}}.md", post: published, wantErr: true},
+		{name: "absolute", layout: "/tmp/{{.Date}}-{{.Slug}}.md", post: published, wantErr: true},
+		{name: "unknown field", layout: "{{.Title}}.md", post: published, wantErr: true},
+		{name: "broken template", layout: "{{.Date", post: published, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPostSynchronizer(nil, nil, t.TempDir(), "blog", SyncOptions{Layout: tt.layout})
+			got, err := p.newPostFileName(tt.post)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
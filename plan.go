@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/writeas/go-writeas/v2"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+type PostActionKind string
+
+const (
+	ActionCreate  PostActionKind = "create"
+	ActionUpdate  PostActionKind = "update"
+	ActionMerge   PostActionKind = "merge"
+	ActionDelete  PostActionKind = "delete"
+	ActionPublish PostActionKind = "publish"
+	ActionSkip    PostActionKind = "skip"
+)
+
+// PostAction is a planned change of a single post
+type PostAction struct {
+	Kind   PostActionKind
+	Slug   string
+	Reason string
+
+	local  *LocalPost
+	remote *writeas.Post
+}
+
+// ImageAction is a planned image transfer
+type ImageAction struct {
+	Path   string
+	Url    string
+	Reason string
+
+	// The post that references the downloaded image
+	datePart, slug string
+}
+
+// SyncPlan describes everything that the synchronization is going to do, without doing it
+type SyncPlan struct {
+	LocalPosts     []PostAction
+	RemotePosts    []PostAction
+	ImageUploads   []ImageAction
+	ImageDownloads []ImageAction
+}
+
+// PlanLocalUpdates determines which remote posts need to be created or updated locally
+func (p *PostSynchronizer) PlanLocalUpdates(remotePosts []writeas.Post) []PostAction {
+	var res []PostAction
+
+	remoteSlugs := make(map[string]bool)
+	for i := range remotePosts {
+		curPost := &remotePosts[i]
+		remoteSlugs[curPost.Slug] = true
+
+		// Find the local file?
+		localPost, ok := p.posts[curPost.Slug]
+		if !ok {
+			reason := "new remote post"
+			if st, synced := p.state.Posts[curPost.Slug]; synced && st.RemoteID == curPost.ID {
+				if !p.isDeletedLocally(st) {
+					// The post is filtered out, it's not synchronized
+					continue
+				}
+				if RemotePostMatchesHash(*curPost, st.RemoteHash) {
+					// The post has been deleted locally, this is propagated during the upload
+					continue
+				}
+				reason = "deleted locally, but changed on the server since the last sync"
+			}
+			res = append(res, PostAction{Kind: ActionCreate, Slug: curPost.Slug,
+				Reason: reason, remote: curPost})
+			continue
+		}
+
+		change, reason := p.classifyChange(localPost, *curPost)
+		switch change {
+		case PostChangedRemotely:
+			res = append(res, PostAction{Kind: ActionUpdate, Slug: curPost.Slug,
+				Reason: reason, local: &localPost, remote: curPost})
+		case PostChangedOnBothSides:
+			if HasConflictMarkers(localPost.content) {
+				res = append(res, PostAction{Kind: ActionSkip, Slug: curPost.Slug,
+					Reason: "the local file has unresolved conflict markers", local: &localPost, remote: curPost})
+			} else {
+				res = append(res, PostAction{Kind: ActionMerge, Slug: curPost.Slug,
+					Reason: reason, local: &localPost, remote: curPost})
+			}
+		}
+	}
+
+	return append(res, p.planRemoteDeletions(remoteSlugs)...)
+}
+
+// planRemoteDeletions finds the posts that have been deleted on the server, they are deleted locally
+func (p *PostSynchronizer) planRemoteDeletions(remoteSlugs map[string]bool) []PostAction {
+	var res []PostAction
+	for _, slug := range p.sortedSlugs() {
+		if remoteSlugs[slug] {
+			continue
+		}
+		localPost := p.posts[slug]
+		st, synced := p.state.Posts[slug]
+		if !synced || ContentHash(localPost.content) != st.LocalHash {
+			// A new or changed local post, it will be uploaded
+			continue
+		}
+		res = append(res, p.deletionAction(slug, "deleted on the server", &localPost, nil))
+	}
+	return res
+}
+
+// PlanRemoteUpdates determines which local posts need to be created or updated on the server
+func (p *PostSynchronizer) PlanRemoteUpdates(remotePosts []writeas.Post) []PostAction {
+	remotes := make(map[string]*writeas.Post)
+	for i := range remotePosts {
+		remotes[remotePosts[i].Slug] = &remotePosts[i]
+	}
+
+	var res []PostAction
+	for _, slug := range p.sortedSlugs() {
+		localPost := p.posts[slug]
+
+		if HasConflictMarkers(localPost.content) {
+			res = append(res, PostAction{Kind: ActionSkip, Slug: slug,
+				Reason: "the local file has unresolved conflict markers", local: &localPost})
+			continue
+		}
+
+		// Do we have the remote post?
+		remote, ok := remotes[slug]
+		if !ok {
+			reason := "new local post"
+			if localPost.isDraft() {
+				reason = "new local draft"
+			}
+			if st, synced := p.state.Posts[slug]; synced {
+				if ContentHash(localPost.content) == st.LocalHash {
+					// The post has been deleted on the server, this is propagated during the download
+					continue
+				}
+				reason = "deleted on the server, but changed locally since the last sync"
+			}
+			res = append(res, PostAction{Kind: ActionCreate, Slug: slug,
+				Reason: reason, local: &localPost})
+			continue
+		}
+
+		change, reason := p.classifyChange(localPost, *remote)
+		if change == PostUnchanged {
+			if img := p.changedImage(localPost); img != "" {
+				change = PostChangedLocally
+				reason = fmt.Sprintf("the image %s has changed", img)
+			}
+		}
+		if change != PostChangedOnBothSides && localPost.isDraft() != isRemoteDraft(*remote) {
+			if localPost.isDraft() {
+				res = append(res, PostAction{Kind: ActionSkip, Slug: slug, local: &localPost, remote: remote,
+					Reason: "the post is marked as a draft, but it's already published, unpublish it on Write.As"})
+			} else {
+				res = append(res, PostAction{Kind: ActionPublish, Slug: slug, local: &localPost, remote: remote,
+					Reason: "the draft flag has been removed"})
+			}
+			continue
+		}
+
+		switch change {
+		case PostChangedLocally:
+			res = append(res, PostAction{Kind: ActionUpdate, Slug: slug,
+				Reason: reason, local: &localPost, remote: remote})
+		case PostChangedOnBothSides:
+			res = append(res, PostAction{Kind: ActionSkip, Slug: slug,
+				Reason: "changed on both sides, download it first to merge the changes",
+				local:  &localPost, remote: remote})
+		}
+	}
+
+	return append(res, p.planLocalDeletions(remotePosts)...)
+}
+
+// planLocalDeletions finds the posts that have been deleted locally, they are deleted on the server
+func (p *PostSynchronizer) planLocalDeletions(remotePosts []writeas.Post) []PostAction {
+	var res []PostAction
+	for i := range remotePosts {
+		remote := &remotePosts[i]
+		if _, ok := p.posts[remote.Slug]; ok {
+			continue
+		}
+		st, synced := p.state.Posts[remote.Slug]
+		if !synced || st.RemoteID != remote.ID || !RemotePostMatchesHash(*remote, st.RemoteHash) {
+			// A new or changed remote post, it will be downloaded
+			continue
+		}
+		if !p.isDeletedLocally(st) {
+			continue
+		}
+		res = append(res, p.deletionAction(remote.Slug, "deleted locally", nil, remote))
+	}
+	return res
+}
+
+// SkippedDeletions finds the deletions that the one-way synchronization doesn't propagate: the posts deleted
+// locally are deleted on the server by the upload, and the posts deleted on the server are deleted locally
+// by the download
+func (p *PostSynchronizer) SkippedDeletions(remotePosts []writeas.Post, doDownload, doUpload bool) []PostAction {
+	var res []PostAction
+	if !doUpload {
+		res = append(res, p.planLocalDeletions(remotePosts)...)
+	}
+	if !doDownload {
+		remoteSlugs := make(map[string]bool)
+		for _, remote := range remotePosts {
+			remoteSlugs[remote.Slug] = true
+		}
+		res = append(res, p.planRemoteDeletions(remoteSlugs)...)
+	}
+	return res
+}
+
+// isDeletedLocally checks if the synchronized post that is missing from the local posts has been deleted,
+// rather than filtered out by the include/exclude globs or the ignore file. The posts without a recorded file
+// are never considered deleted.
+func (p *PostSynchronizer) isDeletedLocally(st PostSyncState) bool {
+	if st.File == "" || (p.filter != nil && p.filter.IsFiltered(st.File)) {
+		return false
+	}
+	_, err := os.Stat(path.Join(p.rootDir, st.File))
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// PlanImageUploads finds the local images that are not yet present on the image hosting, or have changed
+// since they were uploaded
+func (p *PostSynchronizer) PlanImageUploads() ([]ImageAction, error) {
+	var res []ImageAction
+	seen := make(map[string]bool)
+
+	for _, slug := range p.sortedSlugs() {
+		for _, img := range p.posts[slug].images {
+			if seen[img.relPath] {
+				continue
+			}
+			seen[img.relPath] = true
+			if !p.canHost(img) {
+				continue
+			}
+
+			hash, err := p.imageHash(img)
+			if err != nil {
+				return nil, err
+			}
+			_, found, changed := p.findIndexedImage(img, hash)
+			if changed {
+				res = append(res, ImageAction{Path: img.relPath,
+					Reason: fmt.Sprintf("changed image referenced by %s", slug)})
+			} else if _, ok := p.imageSyncer.FindUploadedImage(img); !found && !ok {
+				res = append(res, ImageAction{Path: img.relPath,
+					Reason: fmt.Sprintf("new image referenced by %s", slug)})
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// PlanImageDownloads finds the images referenced by the posts that are going to be downloaded
+func (p *PostSynchronizer) PlanImageDownloads(actions []PostAction) ([]ImageAction, error) {
+	var res []ImageAction
+	seen := make(map[string]bool)
+
+	for _, act := range actions {
+		if act.remote == nil || act.Kind == ActionSkip {
+			continue
+		}
+
+		datePart := act.remote.Created.UTC().Format("2006-01-02")
+		if act.local != nil {
+			datePart = act.local.datePart
+		}
+
+		for _, imgUrl := range FindReferencedImages(act.remote.Content) {
+			relPath, needed, err := p.imageSyncer.PlanImageDownload(imgUrl, datePart, act.Slug)
+			if err != nil {
+				return nil, err
+			}
+			if needed && !seen[relPath] {
+				seen[relPath] = true
+				res = append(res, ImageAction{Path: relPath, Url: imgUrl,
+					Reason: fmt.Sprintf("referenced by %s", act.Slug), datePart: datePart, slug: act.Slug})
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (p *PostSynchronizer) sortedSlugs() []string {
+	var res []string
+	for slug := range p.posts {
+		res = append(res, slug)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// Print writes the human-readable plan
+func (s *SyncPlan) Print(w io.Writer) {
+	printPosts := func(header string, actions []PostAction) {
+		_, _ = fmt.Fprintf(w, "%s:\n", header)
+		if len(actions) == 0 {
+			_, _ = fmt.Fprintf(w, "  (nothing to do)\n")
+		}
+		for _, act := range actions {
+			_, _ = fmt.Fprintf(w, "  %-8s %s (%s)\n", act.Kind, act.Slug, act.Reason)
+		}
+	}
+	printImages := func(header string, actions []ImageAction) {
+		_, _ = fmt.Fprintf(w, "%s:\n", header)
+		if len(actions) == 0 {
+			_, _ = fmt.Fprintf(w, "  (nothing to do)\n")
+		}
+		for _, act := range actions {
+			var parts []string
+			if act.Url != "" {
+				parts = append(parts, act.Url, "->")
+			}
+			parts = append(parts, act.Path)
+			_, _ = fmt.Fprintf(w, "  %s (%s)\n", strings.Join(parts, " "), act.Reason)
+		}
+	}
+
+	printPosts("Local posts", s.LocalPosts)
+	printImages("Images to download", s.ImageDownloads)
+	printImages("Images to upload", s.ImageUploads)
+	printPosts("Remote posts", s.RemotePosts)
+}
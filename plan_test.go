@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/writeas/go-writeas/v2"
+)
+
+func TestPlanDeletionsSkipFilteredPosts(t *testing.T) {
+	rootDir := t.TempDir()
+	files := map[string]string{
+		"kept":   "2024-01-01-kept.md",
+		"hidden": "private/2024-01-02-hidden.md",
+		"gone":   "2024-01-03-gone.md",
+		"moved":  "private/2024-01-04-moved.md",
+	}
+	for _, fname := range []string{files["kept"], files["hidden"]} {
+		fullName := filepath.Join(rootDir, fname)
+		err := os.MkdirAll(filepath.Dir(fullName), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fullName, []byte("Text\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := NewPostSynchronizer(nil, nil, rootDir, "blog",
+		SyncOptions{AllowDelete: true, Exclude: []string{"private"}})
+	err := p.FindFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var remotePosts []writeas.Post
+	for slug, fname := range files {
+		remote := writeas.Post{ID: "id-" + slug, Slug: slug, Content: "Text\n"}
+		remotePosts = append(remotePosts, remote)
+		p.state.RecordSynced(slug, "Text\n", remote)
+		st := p.state.Posts[slug]
+		st.File = fname
+		p.state.Posts[slug] = st
+	}
+
+	deleted := make(map[string]bool)
+	for _, act := range p.PlanRemoteUpdates(remotePosts) {
+		if act.Kind == ActionDelete {
+			deleted[act.Slug] = true
+		}
+	}
+	if !deleted["gone"] || len(deleted) != 1 {
+		t.Errorf("unexpected deletions: %v", deleted)
+	}
+
+	// The filtered posts are not downloaded, even if they have changed remotely
+	for i := range remotePosts {
+		remotePosts[i].Content = "Changed\n"
+	}
+	for _, act := range p.PlanLocalUpdates(remotePosts) {
+		if act.Slug == "hidden" || act.Slug == "moved" {
+			t.Errorf("unexpected %s of the filtered post %s", act.Kind, act.Slug)
+		}
+	}
+}
+
+func TestSkippedDeletions(t *testing.T) {
+	rootDir := t.TempDir()
+	for _, fname := range []string{"2024-01-01-kept.md", "2024-01-03-deleted-remotely.md"} {
+		err := os.WriteFile(filepath.Join(rootDir, fname), []byte("Text\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := NewPostSynchronizer(nil, nil, rootDir, "blog", SyncOptions{AllowDelete: true})
+	err := p.FindFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"kept":             "2024-01-01-kept.md",
+		"deleted-locally":  "2024-01-02-deleted-locally.md",
+		"deleted-remotely": "2024-01-03-deleted-remotely.md",
+	}
+	var remotePosts []writeas.Post
+	for slug, fname := range files {
+		remote := writeas.Post{ID: "id-" + slug, Slug: slug, Content: "Text\n"}
+		if slug != "deleted-remotely" {
+			remotePosts = append(remotePosts, remote)
+		}
+		p.state.RecordSynced(slug, "Text\n", remote)
+		st := p.state.Posts[slug]
+		st.File = fname
+		p.state.Posts[slug] = st
+	}
+
+	tests := []struct {
+		name                 string
+		doDownload, doUpload bool
+		want                 string
+	}{
+		{name: "full sync", doDownload: true, doUpload: true},
+		{name: "download", doDownload: true, want: "deleted-locally"},
+		{name: "upload", doUpload: true, want: "deleted-remotely"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skipped := p.SkippedDeletions(remotePosts, tt.doDownload, tt.doUpload)
+			if tt.want == "" && len(skipped) != 0 {
+				t.Errorf("unexpected skipped deletions: %+v", skipped)
+			}
+			if tt.want != "" && (len(skipped) != 1 || skipped[0].Slug != tt.want) {
+				t.Errorf("unexpected skipped deletions: %+v", skipped)
+			}
+		})
+	}
+}
@@ -1,26 +1,47 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/djherbis/times"
 	"github.com/writeas/go-writeas/v2"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
-	"slices"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
 const AllowedFileTimestampSkew = 2 * time.Second
 
+// DraftsDir is the directory (relative to the blog root) for the posts that are not published in the collection
+const DraftsDir = "drafts"
+
+// DefaultWriteAsFont is the default post appearance on Write.As
+const DefaultWriteAsFont = "norm"
+
 var ObsiSyncFilePattern = regexp.MustCompile(`\d\d\d\d-\d\d-\d\d-.*\.md`)
 
 type LocalImage struct {
 	fullPath string
-	relPath  string
-	size     int64
-	mtime    time.Time
+	// relPath is relative to the blog root, and ref is the image reference in the post
+	relPath string
+	ref     string
+	// embed is set if the image is referenced by an Obsidian embed
+	embed bool
+	// mediaType is the MIME type detected from the contents, the "images" can be other media files as well
+	mediaType string
+	size      int64
+	mtime     time.Time
+	// data is the processed content that is not cached on the disk in the read-only mode, see
+	// ProcessingImageSyncer.ReadOnly
+	data []byte
 }
 
 type LocalPost struct {
@@ -28,8 +49,44 @@ type LocalPost struct {
 	datePart, slug string
 	images         []LocalImage
 	ctime, mtime   time.Time
-	content        string
-	title          string
+	// content is the full file content, and body is the content without the front matter
+	content, body string
+	title         string
+	meta          *FrontMatter
+}
+
+// SyncOptions tunes the behavior of the PostSynchronizer
+type SyncOptions struct {
+	// AllowDelete enables the propagation of the post deletions
+	AllowDelete bool
+	// ArchiveDeleted moves the locally deleted posts into the ArchiveDir instead of removing them
+	ArchiveDeleted bool
+	// AssumeYes skips the interactive confirmation of the deletions
+	AssumeYes bool
+
+	// Include and Exclude are the globs (relative to the blog root) that select the post files
+	Include, Exclude []string
+	// Layout is the template for the paths of the newly downloaded posts, see PostLayoutData
+	Layout string
+	// Jobs is the number of the parallel image transfers
+	Jobs int
+
+	// The drafts don't belong to a collection, so in the multi-blog runs each draft is synchronized by one blog:
+	// the one that has it in its sync state, or the first blog for the drafts that are not synchronized yet.
+	// ClaimedDrafts are the remote IDs recorded in the sync states of all the blogs, and SkipNewDrafts
+	// leaves the drafts that are not claimed by any blog to the first blog.
+	ClaimedDrafts map[string]bool
+	SkipNewDrafts bool
+}
+
+// DefaultPostLayout puts the downloaded posts into the blog root
+const DefaultPostLayout = "{{.Date}}-{{.Slug}}.md"
+
+// PostLayoutData is the data for the SyncOptions.Layout template
+type PostLayoutData struct {
+	Year, Month, Day string
+	Date             string
+	Slug             string
 }
 
 type PostSynchronizer struct {
@@ -37,100 +94,308 @@ type PostSynchronizer struct {
 	client      *writeas.Client
 	rootDir     string
 	collAlias   string
+	opts        SyncOptions
 
 	posts map[string]LocalPost
+	state *SyncState
+	// filter selects the post files, it's set by FindFiles
+	filter *PathFilter
+
+	// Guards the image index in the state, the image hashes computed during this run, and the files
+	// that the image hosting can't store (they are reported once)
+	imagesMtx   sync.Mutex
+	imageHashes map[string]string
+	unsupported map[string]bool
 }
 
-func NewPostSynchronizer(imageSyncer ImageSyncer, client *writeas.Client, rootDir, collAlias string) *PostSynchronizer {
+func NewPostSynchronizer(imageSyncer ImageSyncer, client *writeas.Client, rootDir, collAlias string,
+	opts SyncOptions) *PostSynchronizer {
 
 	return &PostSynchronizer{
 		imageSyncer: imageSyncer,
 		client:      client,
 		rootDir:     rootDir,
 		collAlias:   collAlias,
+		opts:        opts,
 		posts:       make(map[string]LocalPost),
+		state:       &SyncState{Posts: make(map[string]PostSyncState), Images: make(map[string]ImageSyncState)},
+		imageHashes: make(map[string]string),
+		unsupported: make(map[string]bool),
+	}
+}
+
+func (p *PostSynchronizer) LoadState() error {
+	state, err := LoadSyncState(p.rootDir)
+	if err != nil {
+		return err
 	}
+	p.state = state
+
+	// The posts might have been moved since the last sync
+	for slug, local := range p.posts {
+		if st, ok := p.state.Posts[slug]; ok && st.File != local.fname {
+			st.File = local.fname
+			p.state.Posts[slug] = st
+		}
+	}
+	return nil
+}
+
+func (p *PostSynchronizer) SaveState() error {
+	return p.state.Save(p.rootDir)
 }
 
 func (p *PostSynchronizer) FindFiles() error {
-	dir, err := os.ReadDir(p.rootDir)
+	filter, err := LoadPathFilter(p.rootDir, p.opts.Include, p.opts.Exclude)
 	if err != nil {
 		return err
 	}
-	slices.SortFunc(dir, func(a, b os.DirEntry) int {
-		return strings.Compare(a.Name(), b.Name())
-	})
+	p.filter = filter
 
-	for _, d := range dir {
-		fname := d.Name()
-		if !ObsiSyncFilePattern.MatchString(fname) || d.IsDir() {
-			continue
+	return filepath.WalkDir(p.rootDir, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
 		}
-		finfo, err := d.Info()
+		relPath, err := filepath.Rel(p.rootDir, fullPath)
 		if err != nil {
 			return err
 		}
+		relPath = filepath.ToSlash(relPath)
+		if relPath == "." {
+			return nil
+		}
 
-		// Extract the slug
-		parts := strings.SplitN(fname, "-", 4)
-		datePart := strings.Join(parts[0:3], "-")
-		slug := strings.TrimSuffix(parts[3], ".md")
+		if d.IsDir() {
+			if filter.IsExcluded(relPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		content, err := os.ReadFile(path.Join(p.rootDir, fname))
-		if err != nil {
-			return err
+		if !ObsiSyncFilePattern.MatchString(d.Name()) || filter.IsExcluded(relPath) || !filter.IsIncluded(relPath) {
+			return nil
 		}
 
-		images, title, err := GatherPostImagesAndTitle(p.rootDir, content)
+		lp, err := p.readLocalPost(relPath)
 		if err != nil {
 			return err
 		}
+		if existing, ok := p.posts[lp.slug]; ok {
+			return fmt.Errorf("duplicate slug %s in %s and %s", lp.slug, existing.fname, lp.fname)
+		}
+		p.posts[lp.slug] = lp
+		return nil
+	})
+}
 
-		stat, err := times.Stat(path.Join(p.rootDir, fname))
-		if err != nil {
-			return err
+func (p *PostSynchronizer) readLocalPost(fname string) (LocalPost, error) {
+	fullName := path.Join(p.rootDir, fname)
+	finfo, err := os.Stat(fullName)
+	if err != nil {
+		return LocalPost{}, err
+	}
+
+	// Extract the slug
+	parts := strings.SplitN(path.Base(fname), "-", 4)
+	datePart := strings.Join(parts[0:3], "-")
+	slug := strings.TrimSuffix(parts[3], ".md")
+
+	content, err := os.ReadFile(fullName)
+	if err != nil {
+		return LocalPost{}, err
+	}
+
+	meta, body, err := SplitFrontMatter(string(content))
+	if err != nil {
+		return LocalPost{}, fmt.Errorf("%s: %w", fname, err)
+	}
+
+	images, title, err := GatherPostImagesAndTitle(p.rootDir, postDirOf(fname), []byte(body))
+	if err != nil {
+		return LocalPost{}, err
+	}
+
+	if meta != nil {
+		if meta.Slug != "" {
+			slug = meta.Slug
 		}
+		if meta.Title != "" {
+			title = meta.Title
+		}
+	}
+
+	stat, err := times.Stat(fullName)
+	if err != nil {
+		return LocalPost{}, err
+	}
+
+	return LocalPost{
+		fname:    fname,
+		datePart: datePart,
+		slug:     slug,
+		images:   images,
+		mtime:    finfo.ModTime(),
+		ctime:    stat.BirthTime(),
+		content:  string(content),
+		body:     body,
+		title:    title,
+		meta:     meta,
+	}, nil
+}
+
+// postDirOf returns the directory of the post file (relative to the blog root), it's empty for the root itself
+func postDirOf(fname string) string {
+	dir := path.Dir(fname)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
 
-		lp := LocalPost{
-			fname:    fname,
-			datePart: datePart,
-			slug:     slug,
-			images:   images,
-			mtime:    finfo.ModTime(),
-			ctime:    stat.BirthTime(),
-			content:  string(content),
-			title:    title,
+// creationTime returns the post creation time from the front matter, or from the date in the file name
+func (l *LocalPost) creationTime() (time.Time, error) {
+	if l.meta != nil && l.meta.Created != nil {
+		return *l.meta.Created, nil
+	}
+	// The timestamp is basically useless in the current WriteAs API, so we just use the slug part
+	// for the date, to preserve the post order. We use the UTC date at noon.
+	return time.Parse("2006-01-02T15:04:05", l.datePart+"T12:00:00")
+}
+
+// isDraft checks if the post is marked as a draft, either in the front matter or by being in the DraftsDir
+func (l *LocalPost) isDraft() bool {
+	return (l.meta != nil && l.meta.Draft) || strings.HasPrefix(l.fname, DraftsDir+"/")
+}
+
+// hasTitleInFrontMatter checks if the title comes from the front matter rather than from the first heading
+func (l *LocalPost) hasTitleInFrontMatter() bool {
+	return l.meta != nil && l.meta.Title != ""
+}
+
+// classifyChange determines the sync direction for a post that exists on both sides, along with
+// a human-readable reason. Posts that have never been synchronized fall back to the timestamp comparison.
+func (p *PostSynchronizer) classifyChange(local LocalPost, remote writeas.Post) (PostChange, string) {
+	change, known := p.state.ClassifyChange(local, remote)
+	if !known {
+		change = ClassifyChangeByMtime(local, remote)
+		if change == PostUnchanged {
+			// Adopt the post into the state, so that the next sync can use the content hashes
+			p.recordSynced(local.slug, local.content, remote)
 		}
-		p.posts[slug] = lp
+		return change, describeMtimeDelta(local, remote)
 	}
 
-	return nil
+	if change == PostChangedOnBothSides && p.state.Posts[local.slug].Base == "" {
+		// We don't have the base version to merge the changes, so the newest version wins
+		slog.Default().Warn("Post has been changed on both sides, using the newest version",
+			slog.String("slug", local.slug))
+		return ClassifyChangeByMtime(local, remote), "changed on both sides without a base version, " +
+			describeMtimeDelta(local, remote)
+	}
+
+	return change, change.String() + " since the last sync"
 }
 
-func (p *PostSynchronizer) UploadLocalImages() (map[string]string, error) {
-	urlMap := make(map[string]string)
+func describeMtimeDelta(local LocalPost, remote writeas.Post) string {
+	timeDiff := local.mtime.Sub(remote.Updated).Round(time.Second)
+	if timeDiff > 0 {
+		return fmt.Sprintf("the local file is newer by %s", timeDiff)
+	}
+	return fmt.Sprintf("the remote post is newer by %s", -timeDiff)
+}
 
-	for _, curPost := range p.posts {
-		for _, i := range curPost.images {
-			imgUrl, err := p.imageSyncer.EnsureLocalImageIsUploaded(i)
-			if err != nil {
-				return nil, err
+// canHost checks if the image hosting can store the file, the links to the files that it can't store are
+// left as is
+func (p *PostSynchronizer) canHost(img LocalImage) bool {
+	if p.imageSyncer.SupportsMediaType(img.mediaType) {
+		return true
+	}
+
+	p.imagesMtx.Lock()
+	defer p.imagesMtx.Unlock()
+	if !p.unsupported[img.relPath] {
+		p.unsupported[img.relPath] = true
+		slog.Default().Warn("The image hosting doesn't support the file type, skipping it",
+			slog.String("path", img.relPath), slog.String("type", img.mediaType))
+	}
+	return false
+}
+
+// UploadLocalImages uploads the images referenced by the local posts in parallel, the images referenced by
+// several posts are uploaded once. It returns the map of the image paths (relative to the blog root) to their URLs.
+func (p *PostSynchronizer) UploadLocalImages(ctx context.Context) (map[string]string, error) {
+	var images []LocalImage
+	seen := make(map[string]bool)
+	for _, slug := range p.sortedSlugs() {
+		for _, img := range p.posts[slug].images {
+			if !seen[img.relPath] {
+				seen[img.relPath] = true
+				if p.canHost(img) {
+					images = append(images, img)
+				}
 			}
-			urlMap[i.relPath] = imgUrl
 		}
 	}
 
+	urlMap := make(map[string]string)
+	var mtx sync.Mutex
+
+	err := RunParallel(ctx, p.opts.Jobs, len(images), func(ctx context.Context, i int) error {
+		img := images[i]
+		hash, err := p.imageHash(img)
+		if err != nil {
+			return err
+		}
+
+		imgUrl, found, changed := p.findIndexedImage(img, hash)
+		switch {
+		case found:
+		case changed:
+			slog.Default().Info("The image has changed, uploading it again", slog.String("path", img.relPath))
+			imgUrl, err = p.imageSyncer.UploadImage(ctx, img)
+		default:
+			imgUrl, err = p.imageSyncer.EnsureLocalImageIsUploaded(ctx, img)
+		}
+		if err != nil {
+			return err
+		}
+		p.recordImage(img, imgUrl, hash)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		urlMap[img.relPath] = imgUrl
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return urlMap, nil
 }
 
-func (p *PostSynchronizer) LoadRemotePosts() ([]writeas.Post, error) {
+// DownloadImages downloads the images referenced by the posts that are going to be updated locally, in
+// parallel. The posts then find their images already present.
+func (p *PostSynchronizer) DownloadImages(ctx context.Context, actions []PostAction) error {
+	downloads, err := p.PlanImageDownloads(actions)
+	if err != nil {
+		return err
+	}
+
+	return RunParallel(ctx, p.opts.Jobs, len(downloads), func(ctx context.Context, i int) error {
+		act := downloads[i]
+		_, err := p.imageSyncer.DownloadAndSaveImage(ctx, act.Url, act.datePart, act.slug)
+		return err
+	})
+}
+
+func (p *PostSynchronizer) LoadRemotePosts(ctx context.Context) ([]writeas.Post, error) {
 	var res []writeas.Post
 
 	page := uint64(1)
 	for {
 		slog.Default().Info("Fetching a page", slog.Uint64("page", page))
-		posts, err := ReqWithRetries[*[]writeas.Post](func() (*[]writeas.Post, error) {
-			return GetCollectionPostsPaginated(p.client, p.collAlias, page)
+		posts, err := ReqWithRetries[*[]writeas.Post](ctx, func() (*[]writeas.Post, error) {
+			return GetCollectionPostsPaginated(ctx, p.client, p.collAlias, page)
 		})
 		if err != nil {
 			return nil, err
@@ -139,167 +404,440 @@ func (p *PostSynchronizer) LoadRemotePosts() ([]writeas.Post, error) {
 			break
 		}
 
-		res = append(res, *posts...)
+		for _, post := range *posts {
+			// The collection is implied in the response, make it explicit to tell the drafts apart
+			if post.Collection == nil {
+				post.Collection = &writeas.Collection{Alias: p.collAlias}
+			}
+			res = append(res, post)
+		}
 		page++
 	}
 	return res, nil
 }
 
-func (p *PostSynchronizer) UpdateOrCreateLocalPosts(remotePosts []writeas.Post) error {
-	for _, curPost := range remotePosts {
-		// Find the local file?
-		localPost, ok := p.posts[curPost.Slug]
-		if ok {
-			// Check the modification time
-			timeDiff := localPost.mtime.Sub(curPost.Updated)
-			if timeDiff < -AllowedFileTimestampSkew {
-				// The file is substantially newer than the server's post
-				slog.Default().Info("Post has been updated on the server, syncing locally",
-					slog.String("slug", curPost.Slug))
-				err := p.createOrUpdateLocalFile(curPost, &localPost)
-				if err != nil {
-					return err
-				}
-			}
+// LoadRemoteDrafts retrieves the user's posts that don't belong to any collection. The drafts don't have
+// meaningful slugs, so we use the ones from the sync state, or the post IDs for the new drafts. The drafts
+// synchronized by the other blogs are skipped, see SyncOptions.ClaimedDrafts.
+func (p *PostSynchronizer) LoadRemoteDrafts(ctx context.Context) ([]writeas.Post, error) {
+	posts, err := ReqWithRetries[*[]writeas.Post](ctx, func() (*[]writeas.Post, error) {
+		return p.client.GetUserPosts()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slugsById := make(map[string]string)
+	for slug, st := range p.state.Posts {
+		slugsById[st.RemoteID] = slug
+	}
+
+	var res []writeas.Post
+	for _, post := range *posts {
+		if post.Collection != nil {
+			continue
+		}
+		if slug, ok := slugsById[post.ID]; ok {
+			post.Slug = slug
+		} else if p.opts.SkipNewDrafts || p.opts.ClaimedDrafts[post.ID] {
+			continue
 		} else {
-			slog.Default().Info("New remote post", slog.String("slug", curPost.Slug))
-			err := p.createOrUpdateLocalFile(curPost, nil)
+			post.Slug = post.ID
+		}
+		res = append(res, post)
+	}
+
+	return res, nil
+}
+
+func isRemoteDraft(post writeas.Post) bool {
+	return post.Collection == nil
+}
+
+func (p *PostSynchronizer) UpdateOrCreateLocalPosts(ctx context.Context, actions []PostAction) error {
+	err := p.DownloadImages(ctx, actions)
+	if err != nil {
+		return err
+	}
+
+	for _, act := range actions {
+		// Stop between the posts, so that the cancellation doesn't leave a post half-done
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		switch act.Kind {
+		case ActionCreate:
+			slog.Default().Info("New remote post", slog.String("slug", act.Slug))
+			err = p.createOrUpdateLocalFile(ctx, *act.remote, nil)
+		case ActionUpdate:
+			slog.Default().Info("Post has been updated on the server, syncing locally",
+				slog.String("slug", act.Slug), slog.String("reason", act.Reason))
+			err = p.createOrUpdateLocalFile(ctx, *act.remote, act.local)
+		case ActionMerge:
+			err = p.mergeRemotePost(ctx, *act.remote, *act.local)
+		case ActionDelete:
+			err = p.deleteLocalPost(*act.local)
+		case ActionSkip:
+			slog.Default().Warn("Skipping the post", slog.String("slug", act.Slug),
+				slog.String("reason", act.Reason))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renderRemotePost converts the remote post into its local form, downloading the referenced images. The
+// front matter of the existing local post is preserved and updated with the remote metadata.
+func (p *PostSynchronizer) renderRemotePost(ctx context.Context, post writeas.Post, datePart string,
+	postDir string, local *LocalPost) (string, error) {
+
+	linkFixMap, err := ParsePostAndDownloadReferencedImages(ctx, p.imageSyncer, post.Content, datePart, post.Slug)
+	if err != nil {
+		return "", err
+	}
+
+	// The downloaded images are relative to the blog root, make the links relative to the post
+	if postDir != "" {
+		for oldLnk, newLnk := range linkFixMap {
+			relLnk, err := filepath.Rel(postDir, newLnk)
 			if err != nil {
-				return err
+				return "", err
 			}
+			linkFixMap[oldLnk] = filepath.ToSlash(relLnk)
 		}
 	}
 
-	return nil
+	replacements := make(map[string][]MediaRef)
+	for oldLnk, newLnk := range linkFixMap {
+		replacements[oldLnk] = []MediaRef{{Dest: newLnk}}
+	}
+	// The images uploaded from the local post keep their references as they were written, so the post doesn't
+	// change after the round trip. The identical images share the URL, so the references are restored in order.
+	if local != nil {
+		restored := make(map[string][]MediaRef)
+		for _, img := range local.images {
+			imgUrl, ok := p.uploadedImageUrl(img)
+			if _, referenced := replacements[imgUrl]; !ok || !referenced {
+				continue
+			}
+			restored[imgUrl] = append(restored[imgUrl],
+				MediaRef{Dest: referenceSpelling(local.body, img.ref), Embed: img.embed})
+		}
+		for imgUrl, refs := range restored {
+			replacements[imgUrl] = refs
+		}
+	}
+	fixedContent := RewriteReferencesInOrder(post.Content, replacements)
+
+	// Fixup the final "discuss" link: <a href=\"....\">Discuss...</a>
+	re := regexp.MustCompile(`\n\n<a href=".*">Discuss...</a> $`)
+	fixedContent = string(re.ReplaceAll([]byte(fixedContent), []byte("")))
+
+	var meta *FrontMatter
+	if local != nil && local.meta != nil {
+		// Re-parse the front matter, we don't want to modify the local post
+		meta, err = ParseFrontMatter(local.meta.raw)
+		if err != nil {
+			return "", err
+		}
+		// The tags are added to the post body during the upload, they might have been changed remotely
+		if len(meta.Tags) > 0 {
+			var tags []string
+			fixedContent, tags = SplitTags(fixedContent, post.Tags)
+			if tags == nil {
+				tags = []string{}
+			}
+			err = meta.Set("tags", tags)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if local != nil && local.hasTitleInFrontMatter() {
+		err = meta.Set("title", post.Title)
+		if err != nil {
+			return "", err
+		}
+	} else if strings.TrimSpace(post.Title) != "" {
+		// We excluded the title during the upload, re-add it
+		fixedContent = "# " + post.Title + "\n" + fixedContent
+	}
+
+	meta, err = updateFrontMatterFromRemote(meta, post, local)
+	if err != nil {
+		return "", err
+	}
+	if meta != nil {
+		frontMatter, err := meta.Render()
+		if err != nil {
+			return "", err
+		}
+		fixedContent = frontMatter + fixedContent
+	}
+
+	return fixedContent, nil
+}
+
+// updateFrontMatterFromRemote copies the post appearance and its creation time into the front matter. The front
+// matter is created only if the post doesn't use the default appearance.
+func updateFrontMatterFromRemote(meta *FrontMatter, post writeas.Post, local *LocalPost) (*FrontMatter, error) {
+	isRTL := post.RTL != nil && *post.RTL
+	hasCustomFont := post.Font != "" && post.Font != DefaultWriteAsFont
+	if meta == nil {
+		if !isRTL && !hasCustomFont {
+			return nil, nil
+		}
+		meta = &FrontMatter{}
+	}
+
+	if post.Language != nil && (*post.Language != "" || meta.Lang != "") {
+		err := meta.Set("lang", *post.Language)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if isRTL || meta.RTL != nil {
+		err := meta.Set("rtl", isRTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hasCustomFont || meta.Font != "" {
+		err := meta.Set("font", post.Font)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The creation time that comes from the file name is kept there, unless it's been changed remotely
+	var localCreated time.Time
+	if local != nil {
+		localCreated, _ = local.creationTime()
+	}
+	if !post.Created.IsZero() && !post.Created.Equal(localCreated) {
+		err := meta.Set("created", post.Created.UTC())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return meta, nil
 }
 
-func (p *PostSynchronizer) createOrUpdateLocalFile(post writeas.Post, local *LocalPost) error {
+func (p *PostSynchronizer) createOrUpdateLocalFile(ctx context.Context, post writeas.Post, local *LocalPost) error {
 	datePart := post.Created.UTC().Format("2006-01-02")
+	var fname string
 	if local != nil {
 		// Override the remote post's creation date, it might be different from the local one
 		datePart = local.datePart
+		fname = local.fname
+	} else {
+		var err error
+		fname, err = p.newPostFileName(post)
+		if err != nil {
+			return err
+		}
 	}
 
-	fname := path.Join(p.rootDir, datePart+"-"+post.Slug+".md")
-
-	file, err := os.OpenFile(fname, os.O_CREATE|os.O_RDWR, 0644)
+	content, err := p.renderRemotePost(ctx, post, datePart, postDirOf(fname), local)
 	if err != nil {
 		return err
 	}
-	defer func() { _ = file.Close() }()
 
-	linkFixMap, err := ParsePostAndDownloadReferencedImages(p.imageSyncer, post.Content, datePart, post.Slug)
+	err = p.writeLocalPost(fname, content, post.Updated)
 	if err != nil {
 		return err
 	}
 
-	fixedContent := post.Content
-	for oldLnk, newLnk := range linkFixMap {
-		fixedContent = strings.ReplaceAll(fixedContent, "("+oldLnk+")", "("+newLnk+")")
+	p.recordSynced(post.Slug, content, post)
+
+	return nil
+}
+
+// newPostFileName places the new remote post according to the layout template
+func (p *PostSynchronizer) newPostFileName(post writeas.Post) (string, error) {
+	layout := p.opts.Layout
+	if layout == "" {
+		layout = DefaultPostLayout
+	}
+	tmpl, err := template.New("layout").Parse(layout)
+	if err != nil {
+		return "", fmt.Errorf("invalid layout template: %w", err)
 	}
 
-	// Fixup the final "discuss" link: <a href=\"....\">Discuss...</a>
-	re := regexp.MustCompile(`\n\n<a href=".*">Discuss...</a> $`)
-	fixedContent = string(re.ReplaceAll([]byte(fixedContent), []byte("")))
+	created := post.Created.UTC()
+	var buf strings.Builder
+	err = tmpl.Execute(&buf, PostLayoutData{
+		Year:  created.Format("2006"),
+		Month: created.Format("01"),
+		Day:   created.Format("02"),
+		Date:  created.Format("2006-01-02"),
+		Slug:  post.Slug,
+	})
+	if err != nil {
+		return "", err
+	}
 
-	// We excluded the title during the upload, re-add it
-	if strings.TrimSpace(post.Title) != "" {
-		fixedContent = "# " + post.Title + "\n" + fixedContent
+	fname, err := EnsurePathIsRelativeToItsLocation(path.Clean(buf.String()), false)
+	if err != nil {
+		return "", fmt.Errorf("invalid post path %s: %w", buf.String(), err)
+	}
+	if !ObsiSyncFilePattern.MatchString(path.Base(fname)) {
+		return "", fmt.Errorf("the post path %s doesn't match the YYYY-MM-DD-slug.md pattern", fname)
 	}
 
-	_, err = file.WriteString(fixedContent)
+	if isRemoteDraft(post) {
+		fname = path.Join(DraftsDir, fname)
+	}
+	return fname, nil
+}
+
+// mergeRemotePost performs the three-way merge of a post that has been changed on both sides. The merge
+// result is written locally, and it's uploaded during the upload phase unless there are conflicts.
+func (p *PostSynchronizer) mergeRemotePost(ctx context.Context, post writeas.Post, local LocalPost) error {
+	slog.Default().Info("Post has been changed on both sides, merging", slog.String("slug", local.slug))
+
+	remoteContent, err := p.renderRemotePost(ctx, post, local.datePart, postDirOf(local.fname), &local)
 	if err != nil {
 		return err
 	}
 
-	err = os.Chtimes(fname, time.Time{}, post.Updated)
+	merged, hasConflicts := Merge3(p.state.Posts[local.slug].Base, local.content, remoteContent)
+
+	err = p.writeLocalPost(local.fname, merged, time.Now())
 	if err != nil {
 		return err
 	}
 
+	// The remote version becomes the new base, so the merge result is seen as a local change
+	p.recordSynced(local.slug, remoteContent, post)
+
+	if hasConflicts {
+		slog.Default().Warn("Merge conflict, resolve the conflict markers to upload the post",
+			slog.String("slug", local.slug), slog.String("file", local.fname))
+	} else {
+		slog.Default().Info("Merged the changes cleanly", slog.String("slug", local.slug))
+	}
+
 	return nil
 }
 
-func (p *PostSynchronizer) UpdateOrCreateRemotePosts(remotePosts []writeas.Post,
-	imageUrlMap map[string]string) error {
+// writeLocalPost writes the post file and refreshes its in-memory copy, so that
+// the upload doesn't see the stale content
+func (p *PostSynchronizer) writeLocalPost(fname string, content string, mtime time.Time) error {
+	fullName := path.Join(p.rootDir, fname)
+
+	err := WriteFileAtomically(fullName, 0644, mtime, func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-	remotes := make(map[string]writeas.Post)
-	for _, post := range remotePosts {
-		remotes[post.Slug] = post
+	updated, err := p.readLocalPost(fname)
+	if err != nil {
+		return err
 	}
+	p.posts[updated.slug] = updated
 
-	for _, localPost := range p.posts {
-		// Do we have the remote post?
-		remote, ok := remotes[localPost.slug]
-		if ok {
-			timeDiff := localPost.mtime.Sub(remote.Updated)
+	return nil
+}
 
-			if timeDiff > AllowedFileTimestampSkew {
-				slog.Default().Info("File has been updated locally, updating on the server",
-					slog.String("slug", localPost.slug))
-				err := p.uploadLocalPostToServer(localPost, &remote, imageUrlMap)
-				if err != nil {
-					return err
-				}
-			} else {
-				slog.Default().Info("Up-to-date file", slog.String("slug", localPost.slug))
-			}
+func (p *PostSynchronizer) UpdateOrCreateRemotePosts(ctx context.Context, actions []PostAction,
+	imageUrlMap map[string]string) error {
 
-		} else {
-			slog.Default().Info("Uploading new local post", slog.String("slug", localPost.slug))
-			err := p.uploadLocalPostToServer(localPost, nil, imageUrlMap)
-			if err != nil {
-				return err
-			}
+	for _, act := range actions {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		switch act.Kind {
+		case ActionCreate:
+			slog.Default().Info("Uploading new local post", slog.String("slug", act.Slug))
+			err = p.uploadLocalPostToServer(ctx, *act.local, nil, imageUrlMap)
+		case ActionUpdate:
+			slog.Default().Info("File has been updated locally, updating on the server",
+				slog.String("slug", act.Slug), slog.String("reason", act.Reason))
+			err = p.uploadLocalPostToServer(ctx, *act.local, act.remote, imageUrlMap)
+		case ActionPublish:
+			slog.Default().Info("Publishing the draft", slog.String("slug", act.Slug),
+				slog.String("reason", act.Reason))
+			err = p.publishDraft(ctx, *act.local, *act.remote, imageUrlMap)
+		case ActionDelete:
+			err = p.deleteRemotePost(ctx, *act.remote)
+		case ActionSkip:
+			slog.Default().Warn("Skipping the post", slog.String("slug", act.Slug),
+				slog.String("reason", act.Reason))
+		}
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (p *PostSynchronizer) uploadLocalPostToServer(local LocalPost, remote *writeas.Post,
+func (p *PostSynchronizer) uploadLocalPostToServer(ctx context.Context, local LocalPost, remote *writeas.Post,
 	imageUrlMap map[string]string) error {
 
 	// First, fixup the URLs
-	content := local.content
-	for relPath, imgUrl := range imageUrlMap {
-		content = strings.ReplaceAll(content, "("+relPath+")", "("+imgUrl+")")
+	replacements := make(map[string]MediaRef)
+	for _, img := range local.images {
+		if imgUrl, ok := imageUrlMap[img.relPath]; ok {
+			replacements[img.ref] = MediaRef{Dest: imgUrl}
+		}
 	}
+	content := RewriteReferences(local.body, replacements)
 
 	// Remove the title
-	if local.title != "" {
+	if local.title != "" && !local.hasTitleInFrontMatter() {
 		content = strings.Replace(content, "# "+local.title+"\n", "", 1)
 	}
 
+	params := &writeas.PostParams{
+		Content: content,
+		Title:   local.title,
+	}
+	if local.meta != nil {
+		params.Content = AppendTags(content, local.meta.Tags)
+		params.Font = local.meta.Font
+		params.IsRTL = local.meta.RTL
+		if local.meta.Lang != "" {
+			params.Language = &local.meta.Lang
+		}
+	}
+
+	// The creation time is sent with the updates as well, so that the changed date of the post is propagated
+	ctime, err := local.creationTime()
+	if err != nil {
+		return err
+	}
+	params.Created = &ctime
+
+	var newPost *writeas.Post
 	if remote != nil {
-		_, err := ReqWithRetries[*writeas.Post](func() (*writeas.Post, error) {
-			return p.client.UpdatePost(remote.ID, "", &writeas.PostParams{
-				ID:      remote.ID,
-				Updated: &local.mtime,
-				Content: content,
-				Title:   local.title,
-			})
+		params.ID = remote.ID
+		params.Updated = &local.mtime
+		newPost, err = ReqWithRetries[*writeas.Post](ctx, func() (*writeas.Post, error) {
+			return p.client.UpdatePost(remote.ID, "", params)
 		})
 		if err != nil {
 			return err
 		}
 	} else {
-
-		// The timestamp is basically useless in the current WriteAs API, so we just use the slug part
-		// for the date, to preserve the post order. We use the UTC date at noon.
-		ctime, err := time.Parse("2006-01-02T15:04:05", local.datePart+"T12:00:00")
-		if err != nil {
-			return err
+		if !local.isDraft() {
+			params.Collection = p.collAlias
+			params.Slug = local.slug
 		}
-
-		_, err = ReqWithRetries[*writeas.Post](func() (*writeas.Post, error) {
-			return p.client.CreatePost(&writeas.PostParams{
-				Collection: p.collAlias,
-				Slug:       local.slug,
-				Created:    &ctime,
-				Content:    content,
-				Title:      local.title,
-			})
+		newPost, err = ReqWithRetries[*writeas.Post](ctx, func() (*writeas.Post, error) {
+			return p.client.CreatePost(params)
 		})
 		if err != nil {
 			return err
@@ -311,5 +849,50 @@ func (p *PostSynchronizer) uploadLocalPostToServer(local LocalPost, remote *writ
 		//}
 	}
 
+	if local.meta != nil && local.meta.Pinned != nil && !local.isDraft() {
+		p.updatePinnedState(newPost.ID, *local.meta.Pinned)
+	}
+
+	p.recordSynced(local.slug, local.content, *newPost)
+
 	return nil
 }
+
+// publishDraft moves the remote draft into the collection, and then uploads the local changes
+func (p *PostSynchronizer) publishDraft(ctx context.Context, local LocalPost, remote writeas.Post, imageUrlMap map[string]string) error {
+	collected, err := ReqWithRetries[*writeas.Post](ctx, func() (*writeas.Post, error) {
+		return CollectPost(ctx, p.client, p.collAlias, remote.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The collected post gets a slug generated from its title, so replace it with the local one
+	ctime, err := local.creationTime()
+	if err != nil {
+		return err
+	}
+	collected.Slug = local.slug
+	_, err = ReqWithRetries[bool](ctx, func() (bool, error) {
+		return true, SetPostCtime(ctx, p.client, *collected, p.collAlias, local.title, ctime)
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.uploadLocalPostToServer(ctx, local, collected, imageUrlMap)
+}
+
+// updatePinnedState pins or unpins the post, the failures are not fatal
+func (p *PostSynchronizer) updatePinnedState(postID string, pinned bool) {
+	var err error
+	if pinned {
+		err = p.client.PinPost(p.collAlias, &writeas.PinnedPostParams{ID: postID})
+	} else {
+		err = p.client.UnpinPost(p.collAlias, &writeas.PinnedPostParams{ID: postID})
+	}
+	if err != nil {
+		slog.Default().Warn("Failed to update the pinned state of the post",
+			slog.String("id", postID), slog.Bool("pinned", pinned), slog.Any("error", err))
+	}
+}
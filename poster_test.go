@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/writeas/go-writeas/v2"
+)
+
+func TestLoadRemoteDraftsAssignment(t *testing.T) {
+	userPosts := []writeas.Post{
+		{ID: "own"},
+		{ID: "other-blog"},
+		{ID: "new"},
+		{ID: "published", Collection: &writeas.Collection{Alias: "blog"}},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/me/posts" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"code": http.StatusOK, "data": userPosts})
+	}))
+	defer srv.Close()
+	client := writeas.NewClientWith(writeas.Config{URL: srv.URL})
+	claimed := map[string]bool{"own": true, "other-blog": true}
+
+	tests := []struct {
+		name string
+		opts SyncOptions
+		want []string
+	}{
+		{name: "single blog", want: []string{"my-draft", "new", "other-blog"}},
+		{name: "first blog", opts: SyncOptions{ClaimedDrafts: claimed}, want: []string{"my-draft", "new"}},
+		{name: "other blog", opts: SyncOptions{ClaimedDrafts: claimed, SkipNewDrafts: true},
+			want: []string{"my-draft"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPostSynchronizer(nil, client, t.TempDir(), "blog", tt.opts)
+			p.state.RecordSynced("my-draft", "Text\n", writeas.Post{ID: "own"})
+
+			drafts, err := p.LoadRemoteDrafts(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var slugs []string
+			for _, draft := range drafts {
+				slugs = append(slugs, draft.Slug)
+			}
+			sort.Strings(slugs)
+			if !reflect.DeepEqual(slugs, tt.want) {
+				t.Errorf("got %v, want %v", slugs, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadUpdateSendsCreationTime(t *testing.T) {
+	var updated writeas.PostParams
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/posts/id-hello" {
+			http.NotFound(w, r)
+			return
+		}
+		err := json.NewDecoder(r.Body).Decode(&updated)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		post := writeas.Post{ID: "id-hello", Slug: "hello", Content: updated.Content, Created: *updated.Created}
+		_ = json.NewEncoder(w).Encode(map[string]any{"code": http.StatusOK, "data": post})
+	}))
+	defer srv.Close()
+
+	rootDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(rootDir, "2024-01-02-hello.md"),
+		[]byte("---\ncreated: 2024-01-02T08:30:00Z\n---\nText\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPostSynchronizer(nil, writeas.NewClientWith(writeas.Config{URL: srv.URL}), rootDir, "blog",
+		SyncOptions{})
+	err = p.FindFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := writeas.Post{ID: "id-hello", Slug: "hello", Created: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	err = p.uploadLocalPostToServer(context.Background(), p.posts["hello"], &remote, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 1, 2, 8, 30, 0, 0, time.UTC)
+	if updated.Created == nil || !updated.Created.Equal(want) {
+		t.Errorf("the creation time is not updated: %v", updated.Created)
+	}
+}
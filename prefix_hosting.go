@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RemoteImage struct {
+	Url   string
+	Mtime time.Time
+	Size  int64
+	// ETag is the content tag reported by the hosting, it's empty if the hosting doesn't have it
+	ETag string
+}
+
+// prefixHosting is the common part of the image hostings (WebDAV, S3 and a local directory) that publish
+// the images under a URL prefix, at their paths relative to the blog root. The uploads overwrite the images
+// in place, so their URLs stay the same.
+type prefixHosting struct {
+	rootDir       string
+	remoteUrlRoot string
+
+	// The images are uploaded and downloaded in parallel
+	mtx     sync.RWMutex
+	fileMap map[string]RemoteImage
+}
+
+func newPrefixHosting(rootDir, remoteUrlRoot string) *prefixHosting {
+	return &prefixHosting{
+		rootDir:       rootDir,
+		remoteUrlRoot: remoteUrlRoot,
+		fileMap:       make(map[string]RemoteImage),
+	}
+}
+
+func (h *prefixHosting) SupportsMediaType(mediaType string) bool {
+	return true
+}
+
+// imageUrl returns the URL of the image published at the path relative to the blog root
+func (h *prefixHosting) imageUrl(relPath string) (string, error) {
+	return url.JoinPath(h.remoteUrlRoot, relPath)
+}
+
+func (h *prefixHosting) setImage(relPath string, img RemoteImage) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.fileMap[relPath] = img
+}
+
+func (h *prefixHosting) removeImage(relPath string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	delete(h.fileMap, relPath)
+}
+
+// md5EtagRe matches the ETags that are the MD5 of the object, the multipart uploads have a different ETag
+var md5EtagRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// imageMD5 computes the MD5 of the image, it's the ETag of the objects uploaded in a single part
+func imageMD5(img LocalImage) (string, error) {
+	if img.data != nil {
+		hash := md5.Sum(img.data)
+		return hex.EncodeToString(hash[:]), nil
+	}
+
+	file, err := os.Open(img.fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+
+	hash := md5.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// isSameImage compares the contents if the ETag is the MD5, or falls back to the size and the mtime
+func isSameImage(remote RemoteImage, img LocalImage) bool {
+	if remote.Size != img.size {
+		return false
+	}
+	if md5EtagRe.MatchString(remote.ETag) {
+		hash, err := imageMD5(img)
+		return err == nil && hash == remote.ETag
+	}
+	return !remote.Mtime.Before(img.mtime)
+}
+
+func (h *prefixHosting) FindUploadedImage(img LocalImage) (string, bool) {
+	h.mtx.RLock()
+	remoteImg, ok := h.fileMap[img.relPath]
+	h.mtx.RUnlock()
+
+	if ok && isSameImage(remoteImg, img) {
+		return remoteImg.Url, true
+	}
+	return "", false
+}
+
+// resolveDownloadPath returns the sanitized local path for the remote image, it's empty for the
+// images that are not published under our URL prefix
+func (h *prefixHosting) resolveDownloadPath(fullImageUrl string) (string, error) {
+	root := strings.TrimSuffix(h.remoteUrlRoot, "/") + "/"
+	if !strings.HasPrefix(fullImageUrl, root) {
+		return "", nil
+	}
+
+	// The URLs are built by url.JoinPath, so the paths are escaped
+	relPath, err := url.PathUnescape(strings.TrimPrefix(fullImageUrl, root))
+	if err != nil {
+		return "", fmt.Errorf("failed to unescape the path: %w", err)
+	}
+
+	// The escaped separators could hide the parent references, so the unescaped path must be normalized
+	if cleaned := path.Clean(relPath); cleaned != relPath || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("the path is not normalized, look out for malicious input: %s", relPath)
+	}
+	sanitizedRelPath, err := EnsurePathIsRelativeToItsLocation(relPath, false)
+	if err != nil || sanitizedRelPath == "" {
+		return "", fmt.Errorf("failed to sanitize the path: %w", err)
+	}
+
+	return sanitizedRelPath, nil
+}
+
+// isLocalImageCurrent checks if the local copy of the image doesn't need to be downloaded
+func (h *prefixHosting) isLocalImageCurrent(relPath string) (bool, string) {
+	h.mtx.RLock()
+	existing, ok := h.fileMap[relPath]
+	h.mtx.RUnlock()
+	if !ok {
+		return false, ""
+	}
+
+	fullPath := path.Join(h.rootDir, relPath)
+	localFile, err := os.Stat(fullPath)
+	if err != nil {
+		return false, ""
+	}
+	if isSameImage(existing, LocalImage{fullPath: fullPath, size: localFile.Size(), mtime: localFile.ModTime()}) {
+		return true, "The image already exists"
+	}
+	if localFile.ModTime().After(existing.Mtime) {
+		return true, "The local image is newer, skipping the download"
+	}
+	return false, ""
+}
+
+func (h *prefixHosting) PlanImageDownload(fullImageUrl string, postDatePart string, postSlug string) (string, bool, error) {
+	sanitizedRelPath, err := h.resolveDownloadPath(fullImageUrl)
+	if err != nil || sanitizedRelPath == "" {
+		return "", false, err
+	}
+
+	current, _ := h.isLocalImageCurrent(sanitizedRelPath)
+	return sanitizedRelPath, !current, nil
+}
+
+func (h *prefixHosting) HostedImages() []HostedImage {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	var res []HostedImage
+	for relPath, img := range h.fileMap {
+		res = append(res, HostedImage{Url: img.Url, Name: relPath, Created: img.Mtime, id: relPath})
+	}
+	return res
+}
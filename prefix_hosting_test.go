@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestPrefixHostingResolveDownloadPath(t *testing.T) {
+	h := newPrefixHosting(t.TempDir(), "https://img.example.com/blog")
+
+	tests := []struct {
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{url: "https://img.example.com/blog/img/a.png", want: "img/a.png"},
+		{url: "https://img.example.com/blog/my%20img.png", want: "my img.png"},
+		{url: "https://img.example.com/blog2/a.png", want: ""},
+		{url: "https://other.example.com/blog/a.png", want: ""},
+		{url: "https://img.example.com/blog/../a.png", wantErr: true},
+		{url: "https://img.example.com/blog/img/..%2F..%2Fa.png", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := h.resolveDownloadPath(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.url, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixHostingImageUrlRoundTrip(t *testing.T) {
+	h := newPrefixHosting(t.TempDir(), "https://img.example.com/blog/")
+	for _, relPath := range []string{"a.png", "img/my img.png"} {
+		imgUrl, err := h.imageUrl(relPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := h.resolveDownloadPath(imgUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != relPath {
+			t.Errorf("%s: resolved to %q", imgUrl, got)
+		}
+	}
+}
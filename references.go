@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MediaRef is a reference to an image or another media file in a post: a Markdown image or link (inline or
+// reference-style), an HTML tag, or an Obsidian embed
+type MediaRef struct {
+	Dest string
+	// Embed is set for the Obsidian embeds: ![[image.png]]
+	Embed bool
+}
+
+var obsidianEmbedRe = regexp.MustCompile(`!\[\[([^\[\]|#\n]+)(?:[|#][^\[\]\n]*)?]]`)
+
+// The tags that reference the media files, and their attributes with the URLs
+var htmlMediaTagRe = regexp.MustCompile(`(?is)<(?:img|source|video|audio|a)\b[^>]*>`)
+var htmlMediaAttrRe = regexp.MustCompile(`(?is)\s(?:src|srcset|href|poster)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+var htmlSrcsetAttrRe = regexp.MustCompile(`(?is)^\s*srcset`)
+
+func parseMarkdown(input []byte) ast.Node {
+	return parser.NewWithExtensions(parser.CommonExtensions).Parse(input)
+}
+
+// htmlReferences returns the URLs in the media tags of the HTML fragment
+func htmlReferences(html []byte) []string {
+	var res []string
+	for _, tag := range htmlMediaTagRe.FindAll(html, -1) {
+		for _, m := range htmlMediaAttrRe.FindAllSubmatch(tag, -1) {
+			val := string(m[1]) + string(m[2]) + string(m[3])
+			if !htmlSrcsetAttrRe.Match(m[0]) {
+				res = append(res, strings.TrimSpace(val))
+				continue
+			}
+			// The srcset is a list of the URLs with their sizes: "small.png 1x, large.png 2x"
+			for _, candidate := range strings.Split(val, ",") {
+				if fields := strings.Fields(candidate); len(fields) > 0 {
+					res = append(res, fields[0])
+				}
+			}
+		}
+	}
+	return res
+}
+
+// nodeReferences returns the media references in the AST node (not including its children)
+func nodeReferences(node ast.Node) []MediaRef {
+	var res []MediaRef
+	switch n := node.(type) {
+	case *ast.Image:
+		res = append(res, MediaRef{Dest: string(n.Destination)})
+	case *ast.Link:
+		// The bare URLs are turned into the links as well, they have to stay URLs
+		children := n.GetChildren()
+		if len(children) == 1 && children[0].AsLeaf() != nil &&
+			string(children[0].AsLeaf().Literal) == string(n.Destination) {
+			return nil
+		}
+		res = append(res, MediaRef{Dest: string(n.Destination)})
+	case *ast.HTMLSpan:
+		for _, dest := range htmlReferences(n.Literal) {
+			res = append(res, MediaRef{Dest: dest})
+		}
+	case *ast.HTMLBlock:
+		for _, dest := range htmlReferences(n.Literal) {
+			res = append(res, MediaRef{Dest: dest})
+		}
+	case *ast.Text:
+		for _, m := range obsidianEmbedRe.FindAllSubmatch(n.Literal, -1) {
+			res = append(res, MediaRef{Dest: strings.TrimSpace(string(m[1])), Embed: true})
+		}
+	}
+	return res
+}
+
+// FindMediaReferences returns all the media references in the post, in the document order
+func FindMediaReferences(content []byte) []MediaRef {
+	var res []MediaRef
+	ast.WalkFunc(parseMarkdown(content), func(node ast.Node, entering bool) ast.WalkStatus {
+		if entering {
+			res = append(res, nodeReferences(node)...)
+		}
+		return ast.GoToNext
+	})
+	return res
+}
+
+// refLocation is the position of the reference destination in the post source
+type refLocation struct {
+	start, end int
+	dest       string
+	embed      bool
+}
+
+// markdownPunctuation are the characters that can be backslash-escaped in the Markdown destinations
+const markdownPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// destinationPattern matches the destination as it can be written in the post source, with any of its
+// punctuation characters escaped: a\_b.png is the a_b.png destination
+func destinationPattern(dest string) *regexp.Regexp {
+	var pattern strings.Builder
+	for _, r := range dest {
+		if strings.ContainsRune(markdownPunctuation, r) {
+			pattern.WriteString(`\\?`)
+		}
+		pattern.WriteString(regexp.QuoteMeta(string(r)))
+	}
+	return regexp.MustCompile(pattern.String())
+}
+
+// locateReferences finds the positions of the destinations in the post source. The source offsets can't be
+// recorded during the AST walk: gomarkdown doesn't keep the positions of the inline nodes, and the destinations
+// are unescaped into new buffers. Instead, each occurrence of a destination (in any of its spellings) is
+// replaced with a unique marker, and the markers that the parser sees as the reference destinations are
+// the real references. The other occurrences (in the code blocks, in the titles, in the text or as a part of
+// the other URLs) are not returned.
+func locateReferences(content string, dests []string) []refLocation {
+	unique := make(map[string]bool)
+	var sorted []string
+	for _, dest := range dests {
+		if dest != "" && !unique[dest] {
+			unique[dest] = true
+			sorted = append(sorted, dest)
+		}
+	}
+	// The longer destinations go first, so a destination that is a part of the other one is not matched
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	claimed := make([]bool, len(content))
+	var candidates []refLocation
+	for _, dest := range sorted {
+		for _, m := range destinationPattern(dest).FindAllStringIndex(content, -1) {
+			start, end := m[0], m[1]
+			if claimed[start] || claimed[end-1] {
+				continue
+			}
+			for i := start; i < end; i++ {
+				claimed[i] = true
+			}
+			candidates = append(candidates, refLocation{start: start, end: end, dest: dest})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].start < candidates[j].start })
+
+	markerPrefix := "writeas-sync-ref-"
+	for strings.Contains(content, markerPrefix) {
+		markerPrefix += "x-"
+	}
+	var marked strings.Builder
+	markers := make(map[string]int)
+	last := 0
+	for i, c := range candidates {
+		marker := fmt.Sprintf("%s%d", markerPrefix, i)
+		markers[marker] = i
+		marked.WriteString(content[last:c.start])
+		marked.WriteString(marker)
+		last = c.end
+	}
+	marked.WriteString(content[last:])
+
+	found := make(map[int]bool)
+	for _, ref := range FindMediaReferences([]byte(marked.String())) {
+		if i, ok := markers[ref.Dest]; ok {
+			found[i] = true
+			candidates[i].embed = ref.Embed
+		}
+	}
+
+	var res []refLocation
+	for i, c := range candidates {
+		if found[i] {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// referenceSpelling returns the destination as it's written in the post source, with its escapes
+func referenceSpelling(content string, dest string) string {
+	for _, loc := range locateReferences(content, []string{dest}) {
+		return content[loc.start:loc.end]
+	}
+	return dest
+}
+
+// embedSpan returns the bounds of the Obsidian embed around the destination
+func embedSpan(content string, loc refLocation) (int, int, bool) {
+	start := strings.LastIndex(content[:loc.start], "![[")
+	end := strings.Index(content[loc.end:], "]]")
+	if start < 0 || end < 0 {
+		return 0, 0, false
+	}
+	return start, loc.end + end + 2, true
+}
+
+// markdownDestination escapes the link destination if it has the spaces or the parentheses
+func markdownDestination(dest string) string {
+	if strings.ContainsAny(dest, " ()<>") {
+		return "<" + strings.NewReplacer("<", "%3C", ">", "%3E").Replace(dest) + ">"
+	}
+	return dest
+}
+
+// destinationText spells the new destination at the location of the old one. The bare destinations of the inline
+// Markdown links are escaped, the ones in the angle brackets and in the HTML attributes are written as is. The
+// reference definitions are written as is too, gomarkdown doesn't support the angle brackets there.
+func destinationText(content string, loc refLocation, dest string) string {
+	if strings.HasSuffix(strings.TrimRight(content[:loc.start], " \t"), "](") {
+		return markdownDestination(dest)
+	}
+	return dest
+}
+
+// imageSpan returns the bounds of the Markdown image without the alt text and the title around the destination,
+// it's the form the Obsidian embeds are published in
+func imageSpan(content string, loc refLocation) (int, int, bool) {
+	for _, form := range [][2]string{{"![](", ")"}, {"![](<", ">)"}} {
+		if strings.HasSuffix(content[:loc.start], form[0]) && strings.HasPrefix(content[loc.end:], form[1]) {
+			return loc.start - len(form[0]), loc.end + len(form[1]), true
+		}
+	}
+	return 0, 0, false
+}
+
+// RewriteReferences replaces the media references in the post, the replacements map the old destinations
+// to the new references. The rest of the post is left byte-for-byte intact. The Obsidian embeds become the
+// Markdown images if the new reference is not an embed (the other Markdown renderers don't support them),
+// and the images published from the embeds become the embeds again if the new reference is one.
+func RewriteReferences(content string, replacements map[string]MediaRef) string {
+	ordered := make(map[string][]MediaRef)
+	for dest, newRef := range replacements {
+		ordered[dest] = []MediaRef{newRef}
+	}
+	return RewriteReferencesInOrder(content, ordered)
+}
+
+// RewriteReferencesInOrder is RewriteReferences with a list of the new references for each old destination.
+// The occurrences of the destination get the new references in the document order, and the last one is used
+// for the rest of them.
+func RewriteReferencesInOrder(content string, replacements map[string][]MediaRef) string {
+	if len(replacements) == 0 {
+		return content
+	}
+	var dests []string
+	pending := make(map[string][]MediaRef)
+	for dest, newRefs := range replacements {
+		if len(newRefs) > 0 {
+			dests = append(dests, dest)
+			pending[dest] = newRefs
+		}
+	}
+
+	var res strings.Builder
+	last := 0
+	replaced := make(map[string]bool)
+	for _, loc := range locateReferences(content, dests) {
+		start, end := loc.start, loc.end
+		newRefs := pending[loc.dest]
+		newRef := newRefs[0]
+		if len(newRefs) > 1 {
+			pending[loc.dest] = newRefs[1:]
+		}
+		text := destinationText(content, loc, newRef.Dest)
+		if loc.embed && !newRef.Embed {
+			var ok bool
+			start, end, ok = embedSpan(content, loc)
+			if !ok || start < last {
+				continue
+			}
+			text = "![](" + markdownDestination(newRef.Dest) + ")"
+		} else if !loc.embed && newRef.Embed {
+			if imgStart, imgEnd, ok := imageSpan(content, loc); ok && imgStart >= last {
+				start, end = imgStart, imgEnd
+				text = "![[" + newRef.Dest + "]]"
+			}
+		}
+		res.WriteString(content[last:start])
+		res.WriteString(text)
+		last = end
+		replaced[loc.dest] = true
+	}
+	res.WriteString(content[last:])
+
+	for _, dest := range dests {
+		if !replaced[dest] {
+			slog.Default().Warn("Could not find the reference in the post, it's left as is",
+				slog.String("reference", dest))
+		}
+	}
+	return res.String()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/writeas/go-writeas/v2"
+)
+
+const testImageUrlRoot = "https://img.example.com/blog"
+
+func writeTestImage(t *testing.T, fileName string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	if strings.HasSuffix(fileName, ".jpg") {
+		err = jpeg.Encode(file, img, nil)
+	} else {
+		err = png.Encode(file, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newFakeWriteAs emulates the post creation, the created post is stored in `created`
+func newFakeWriteAs(t *testing.T, created *writeas.Post) *writeas.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/collections/blog/posts" {
+			http.NotFound(w, r)
+			return
+		}
+		var params writeas.PostParams
+		err := json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*created = writeas.Post{
+			ID:      "id-" + params.Slug,
+			Slug:    params.Slug,
+			Title:   params.Title,
+			Content: params.Content,
+			Created: *params.Created,
+			Updated: *params.Created,
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"code": http.StatusCreated, "data": created})
+	}))
+	t.Cleanup(srv.Close)
+	return writeas.NewClientWith(writeas.Config{URL: srv.URL})
+}
+
+// roundTrip uploads the post and then downloads it back, it returns the uploaded content and the downloaded file
+func roundTrip(t *testing.T, content string, images []string) (string, string) {
+	rootDir := t.TempDir()
+	for _, img := range images {
+		writeTestImage(t, filepath.Join(rootDir, img))
+	}
+	const fname = "2024-01-02-hello.md"
+	err := os.WriteFile(filepath.Join(rootDir, fname), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var remote writeas.Post
+	p := NewPostSynchronizer(NewFilesystemSync(rootDir, t.TempDir(), testImageUrlRoot),
+		newFakeWriteAs(t, &remote), rootDir, "blog", SyncOptions{Jobs: 2})
+	ctx := context.Background()
+
+	err = p.FindFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, ok := p.posts["hello"]
+	if !ok {
+		t.Fatal("the post is not found")
+	}
+	urlMap, err := p.UploadLocalImages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.uploadLocalPostToServer(ctx, local, nil, urlMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.createOrUpdateLocalFile(ctx, remote, &local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := os.ReadFile(filepath.Join(rootDir, fname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return remote.Content, string(downloaded)
+}
+
+func TestReferencesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		images  []string
+		// unchanged are the parts of the post that must be uploaded as is
+		unchanged []string
+	}{
+		{
+			name: "code",
+			content: "# Hello\n\n![A](img/a.png)\n\n```\n![A](img/a.png)\n```\n\n" +
+				"Inline `![A](img/a.png)` code.\n",
+			images:    []string{"img/a.png"},
+			unchanged: []string{"```\n![A](img/a.png)\n```", "`![A](img/a.png)`"},
+		},
+		{
+			name:      "title",
+			content:   "# Hello\n\n![A](img/a.png \"img/a.png caption\")\n",
+			images:    []string{"img/a.png"},
+			unchanged: []string{` "img/a.png caption")`},
+		},
+		{
+			name:      "reference definition",
+			content:   "# Hello\n\n![Logo][logo]\n\n[logo]: img/logo.png \"Logo\"\n",
+			images:    []string{"img/logo.png"},
+			unchanged: []string{"![Logo][logo]", ` "Logo"`},
+		},
+		{
+			name: "html",
+			content: "# Hello\n\n<img src=\"img/a.png\" srcset=\"img/small.png 1x, img/large.png 2x\">\n\n" +
+				"Inline <img src='img/a.png' alt=\"img/a.png\"> image.\n",
+			images:    []string{"img/a.png", "img/small.png", "img/large.png"},
+			unchanged: []string{` alt="img/a.png"`, " 1x, ", " 2x\">"},
+		},
+		{
+			name:    "angle brackets",
+			content: "# Hello\n\n![A](<my img.png>)\n",
+			images:  []string{"my img.png"},
+		},
+		{
+			name:    "spaces and parentheses",
+			content: "# Hello\n\n![A](<my img (1).png>)\n\n![B](<img/b (2).png> \"Title\")\n",
+			images:  []string{"my img (1).png", "img/b (2).png"},
+		},
+		{
+			name:    "obsidian embed",
+			content: "# Hello\n\nText ![[minerals/obsidian.jpg]] text.\n",
+			images:  []string{"minerals/obsidian.jpg"},
+		},
+		{
+			// The test images are identical, so they share the uploaded URL
+			name:    "identical images",
+			content: "# Hello\n\n![A](a.png) ![B](img/b.png)\n\n![[img/b.png]] ![A again](a.png)\n",
+			images:  []string{"a.png", "img/b.png"},
+		},
+		{
+			name:    "escaped destination",
+			content: "# Hello\n\n![A](a\\_b.png)\n",
+			images:  []string{"a_b.png"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploaded, downloaded := roundTrip(t, tt.content, tt.images)
+
+			for _, ref := range FindMediaReferences([]byte(uploaded)) {
+				if !strings.HasPrefix(ref.Dest, testImageUrlRoot+"/") {
+					t.Errorf("the reference %q is not uploaded: %s", ref.Dest, uploaded)
+				}
+			}
+			for _, part := range tt.unchanged {
+				if !strings.Contains(uploaded, part) {
+					t.Errorf("%q is changed in the uploaded post: %s", part, uploaded)
+				}
+			}
+			if downloaded != tt.content {
+				t.Errorf("the downloaded post is different:\n%s\nexpected:\n%s", downloaded, tt.content)
+			}
+		})
+	}
+}
+
+func TestRewriteReferencesEscaped(t *testing.T) {
+	replacements := map[string]MediaRef{"a_b.png": {Dest: "https://img.example.com/a_b.png"}}
+	got := RewriteReferences("![A](a\\_b.png) and `a\\_b.png`\n", replacements)
+	want := "![A](https://img.example.com/a_b.png) and `a\\_b.png`\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRewriteReferencesDestinationSpelling(t *testing.T) {
+	const remote = "https://img.example.com/my%20img%20(1).png"
+	const local = "my img (1).png"
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "inline", content: "![A](" + remote + ")\n", want: "![A](<" + local + ">)\n"},
+		{name: "inline with title", content: "![A](" + remote + " \"T\")\n", want: "![A](<" + local + "> \"T\")\n"},
+		{name: "angle brackets", content: "![A](<" + remote + ">)\n", want: "![A](<" + local + ">)\n"},
+		{name: "html", content: "<img src=\"" + remote + "\">\n", want: "<img src=\"" + local + "\">\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RewriteReferences(tt.content, map[string]MediaRef{remote: {Dest: local}})
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			refs := FindMediaReferences([]byte(got))
+			if len(refs) != 1 || refs[0].Dest != local {
+				t.Errorf("the rewritten reference is parsed as %+v", refs)
+			}
+		})
+	}
+}
@@ -1,26 +1,180 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/studio-b12/gowebdav"
+	"io"
 	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-func ReqWithRetries[T any](f func() (T, error)) (T, error) {
-	time.Sleep(1 * time.Second)
+// RetryPolicy describes how the failed requests are retried
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Deadline limits the total time spent on a request, including the waits between the attempts
+	Deadline time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     time.Minute,
+	Deadline:       5 * time.Minute,
+}
+
+// retryPolicy is used by ReqWithRetries, it's configured from the command line
+var retryPolicy = DefaultRetryPolicy
+
+// ReqWithRetries runs the request, retrying the transient failures according to the configured policy
+func ReqWithRetries[T any](ctx context.Context, f func() (T, error)) (T, error) {
+	return ReqWithPolicy(ctx, retryPolicy, f)
+}
 
-	var err error
-	var res T
-	for i := 0; i < 3; i++ {
-		res, err = f()
+func ReqWithPolicy[T any](ctx context.Context, policy RetryPolicy, f func() (T, error)) (T, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			var zero T
+			return zero, err
+		}
+
+		res, err := f()
 		if err == nil {
 			return res, nil
 		}
 
-		timeToWaitMs := int64(15000 * (i + 2))
-		slog.Default().Warn("Encountered an error. Deploying a workaround and waiting.",
-			slog.Int64("time-to-wait-millis", timeToWaitMs))
-		time.Sleep(time.Millisecond * time.Duration(timeToWaitMs))
+		retryable, retryAfter := ClassifyError(err)
+		if !retryable || attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			return res, err
+		}
+
+		wait := max(policy.backoff(attempt), retryAfter)
+		if policy.Deadline > 0 && time.Since(start)+wait > policy.Deadline {
+			return res, fmt.Errorf("giving up after %d attempt(s): %w", attempt, err)
+		}
+
+		slog.Default().Warn("Request failed, retrying", slog.Int("attempt", attempt),
+			slog.Duration("wait", wait), slog.Any("error", err))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return res, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff is the exponential backoff with jitter: a random duration between the half and the full
+// backoff interval
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// HttpStatusError is returned when the server responds with an unexpected status
+type HttpStatusError struct {
+	StatusCode int
+	Status     string
+	Message    string
+	// RetryAfter is the wait requested by the server in the Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func NewHttpStatusError(resp *http.Response, message string) *HttpStatusError {
+	return &HttpStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Message:    message,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("%s, status=%s", e.Message, e.Status)
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return max(time.Until(when), 0)
+	}
+	return 0
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500
+}
+
+// writeAsStatusRe extracts the status code from the go-writeas errors, such as "Problem creating post: 503. ..."
+var writeAsStatusRe = regexp.MustCompile(`^Problem [^:]*: (\d{3})\b`)
+
+// transientTransportErrorRe matches the messages of the transient transport failures, see ClassifyError
+var transientTransportErrorRe = regexp.MustCompile(`(?i)timeout|connection refused|connection reset|unexpected EOF`)
+
+// ClassifyError checks if the request can be retried: the timeouts, the refused or reset connections, the
+// truncated responses, 429 and 5xx are transient, while the other errors (like 4xx or the malformed responses)
+// are not. It also returns the wait requested by the server.
+func ClassifyError(err error) (bool, time.Duration) {
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.StatusCode), statusErr.RetryAfter
+	}
+
+	var webDavErr gowebdav.StatusError
+	if errors.As(err, &webDavErr) {
+		return isRetryableStatus(webDavErr.Status), 0
+	}
+
+	var s3Err minio.ErrorResponse
+	if errors.As(err, &s3Err) && s3Err.StatusCode != 0 {
+		return isRetryableStatus(s3Err.StatusCode), 0
+	}
+
+	// The other network failures (such as the DNS or the TLS errors) are not going away by themselves
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, 0
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true, 0
+	}
+
+	// The go-writeas library returns the plain-text errors
+	msg := err.Error()
+	if m := writeAsStatusRe.FindStringSubmatch(msg); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		return isRetryableStatus(status), 0
+	}
+	if strings.HasPrefix(msg, "Request: ") && transientTransportErrorRe.MatchString(msg) {
+		// The transport failure, the library keeps only its message
+		return true, 0
 	}
 
-	return res, err
+	return false, 0
 }
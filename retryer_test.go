@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestClassifyError(t *testing.T) {
+	var v any
+	syntaxErr := json.Unmarshal([]byte("<html>Bad gateway</html>"), &v)
+
+	dialErr := func(errno syscall.Errno) error {
+		return &url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Net: "tcp",
+			Err: &os.SyscallError{Syscall: "connect", Err: errno}}}
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		wait      time.Duration
+	}{
+		{name: "too many requests", err: &HttpStatusError{StatusCode: http.StatusTooManyRequests,
+			RetryAfter: time.Minute}, retryable: true, wait: time.Minute},
+		{name: "server error", err: &HttpStatusError{StatusCode: http.StatusServiceUnavailable}, retryable: true},
+		{name: "not found", err: &HttpStatusError{StatusCode: http.StatusNotFound}},
+		{name: "s3 server error", err: minio.ErrorResponse{StatusCode: http.StatusInternalServerError},
+			retryable: true},
+		{name: "connection refused", err: dialErr(syscall.ECONNREFUSED), retryable: true},
+		{name: "connection reset", err: dialErr(syscall.ECONNRESET), retryable: true},
+		{name: "timeout", err: &url.Error{Op: "Get", URL: "https://example.com",
+			Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, retryable: true},
+		{name: "unknown host", err: &url.Error{Op: "Get", URL: "https://example.com",
+			Err: &net.DNSError{Err: "no such host", IsNotFound: true}}},
+		{name: "truncated response", err: fmt.Errorf("failed to read: %w", io.ErrUnexpectedEOF), retryable: true},
+		{name: "malformed response", err: syntaxErr},
+		{name: "write.as server error", err: errors.New("Problem creating post: 503. Service unavailable"),
+			retryable: true},
+		{name: "write.as client error", err: errors.New("Problem creating post: 400. Bad request")},
+		{name: "write.as timeout", err: errors.New(`Request: Post "https://write.as/api/posts": ` +
+			"net/http: TLS handshake timeout"), retryable: true},
+		{name: "write.as unknown host", err: errors.New(`Request: Post "https://write.as/api/posts": ` +
+			"dial tcp: lookup write.as: no such host")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryable, wait := ClassifyError(tt.err)
+			if retryable != tt.retryable || wait != tt.wait {
+				t.Errorf("got (%t, %v), want (%t, %v)", retryable, wait, tt.retryable, tt.wait)
+			}
+		})
+	}
+}
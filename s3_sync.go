@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// S3Settings describes the S3-compatible bucket with the images
+type S3Settings struct {
+	// Endpoint is the URL of the S3 API, e.g.: https://s3.eu-central-1.amazonaws.com
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	PathStyle bool
+	// AccessKey and SecretKey are taken from the AWS_* or MINIO_* environment variables, or from
+	// the ~/.aws/credentials file if they are not specified
+	AccessKey string
+	SecretKey string
+}
+
+// The S3 requests are retried by ReqWithRetries, according to the configured policy. The version of minio-go
+// that we use has no per-client retry setting, so its own retries are disabled for all the clients at once.
+func init() {
+	minio.MaxRetry = 1
+}
+
+// NewS3Client connects to the S3-compatible storage
+func NewS3Client(sets S3Settings) (*minio.Client, error) {
+	endpoint, err := url.Parse(sets.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	if endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint, expected http(s)://host[:port]: %s", sets.Endpoint)
+	}
+
+	var creds *credentials.Credentials
+	if sets.AccessKey != "" {
+		creds = credentials.NewStaticV4(sets.AccessKey, sets.SecretKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+		})
+	}
+
+	lookup := minio.BucketLookupAuto
+	if sets.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	return minio.New(endpoint.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       endpoint.Scheme == "https",
+		Region:       sets.Region,
+		BucketLookup: lookup,
+	})
+}
+
+type S3Sync struct {
+	*prefixHosting
+
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+var _ ImageSyncer = &S3Sync{}
+
+func NewS3Sync(client *minio.Client, bucket, prefix, rootDir, remoteUrlRoot string) *S3Sync {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3Sync{
+		prefixHosting: newPrefixHosting(rootDir, remoteUrlRoot),
+		client:        client,
+		bucket:        bucket,
+		prefix:        strings.TrimPrefix(prefix, "/"),
+	}
+}
+
+func (s *S3Sync) Backend() string {
+	return "s3:" + s.remoteUrlRoot
+}
+
+func (s *S3Sync) BuildImageMap(ctx context.Context) error {
+	objects, err := ReqWithRetries[[]minio.ObjectInfo](ctx, func() ([]minio.ObjectInfo, error) {
+		var objects []minio.ObjectInfo
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+			Prefix:    s.prefix,
+			Recursive: true,
+		}) {
+			if obj.Err != nil {
+				return nil, obj.Err
+			}
+			objects = append(objects, obj)
+		}
+		return objects, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, obj := range objects {
+		relPath := strings.TrimPrefix(obj.Key, s.prefix)
+		if strings.HasSuffix(relPath, "/") {
+			continue // A directory placeholder
+		}
+		// Make sure we're not getting hacked
+		_, err := EnsurePathIsRelativeToItsLocation(relPath, false)
+		if err != nil {
+			return fmt.Errorf("DANGER! Received a malicious filename from S3: %s", obj.Key)
+		}
+
+		imgUrl, err := s.imageUrl(relPath)
+		if err != nil {
+			return err
+		}
+		s.fileMap[relPath] = RemoteImage{Url: imgUrl, Mtime: obj.LastModified, Size: obj.Size, ETag: normalizeETag(obj.ETag)}
+	}
+
+	return nil
+}
+
+// normalizeETag strips the quotes, so that the ETag can be compared with the MD5 of the file
+func normalizeETag(etag string) string {
+	return strings.ToLower(strings.Trim(etag, `"`))
+}
+
+func (s *S3Sync) EnsureLocalImageIsUploaded(ctx context.Context, img LocalImage) (string, error) {
+	if imgUrl, ok := s.FindUploadedImage(img); ok {
+		return imgUrl, nil
+	}
+	return s.UploadImage(ctx, img)
+}
+
+func (s *S3Sync) UploadImage(ctx context.Context, img LocalImage) (string, error) {
+	slog.Default().Info("Uploading new or changed local image", slog.String("path", img.relPath),
+		slog.String("name", img.fullPath), slog.Int64("size", img.size))
+
+	imgUrl, err := s.imageUrl(img.relPath)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := ReqWithRetries[minio.UploadInfo](ctx, func() (minio.UploadInfo, error) {
+		return s.client.FPutObject(ctx, s.bucket, s.prefix+img.relPath, img.fullPath, minio.PutObjectOptions{
+			ContentType: img.mediaType,
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	s.setImage(img.relPath, RemoteImage{
+		Url:   imgUrl,
+		Mtime: info.LastModified,
+		Size:  info.Size,
+		ETag:  normalizeETag(info.ETag),
+	})
+
+	slog.Default().Info("Uploaded local image", slog.String("url", imgUrl))
+
+	return imgUrl, nil
+}
+
+func (s *S3Sync) DownloadAndSaveImage(ctx context.Context, fullImageUrl string, postDatePart string, postSlug string) (string, error) {
+	sanitizedRelPath, err := s.resolveDownloadPath(fullImageUrl)
+	if err != nil || sanitizedRelPath == "" {
+		return "", err
+	}
+
+	if current, msg := s.isLocalImageCurrent(sanitizedRelPath); current {
+		slog.Default().Info(msg, slog.String("dest", sanitizedRelPath))
+		return sanitizedRelPath, nil
+	}
+
+	slog.Default().Info("Downloading image", slog.String("dest", sanitizedRelPath))
+
+	sanitizedAbsPath := path.Join(s.rootDir, sanitizedRelPath)
+	stat, err := ReqWithRetries[minio.ObjectInfo](ctx, func() (minio.ObjectInfo, error) {
+		return s.doDownload(ctx, sanitizedAbsPath, s.prefix+sanitizedRelPath)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slog.Default().Info("Downloaded the image", slog.String("dest", sanitizedRelPath))
+
+	s.setImage(sanitizedRelPath, RemoteImage{
+		Url:   fullImageUrl,
+		Mtime: stat.LastModified,
+		Size:  stat.Size,
+		ETag:  normalizeETag(stat.ETag),
+	})
+
+	return sanitizedRelPath, nil
+}
+
+func (s *S3Sync) doDownload(ctx context.Context, absFilePath string, key string) (minio.ObjectInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	defer func() { _ = obj.Close() }()
+
+	// The request is sent lazily, so Stat reports the missing objects
+	stat, err := obj.Stat()
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+
+	return stat, WriteFileAtomically(absFilePath, 0644, stat.LastModified, func(w io.Writer) error {
+		_, err := io.Copy(w, obj)
+		return err
+	})
+}
+
+func (s *S3Sync) DeleteHostedImage(ctx context.Context, img HostedImage) error {
+	_, err := ReqWithRetries[bool](ctx, func() (bool, error) {
+		return true, s.client.RemoveObject(ctx, s.bucket, s.prefix+img.id, minio.RemoveObjectOptions{})
+	})
+	if err != nil {
+		return err
+	}
+
+	s.removeImage(img.id)
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const testS3Bucket = "bucket"
+
+type fakeS3Object struct {
+	data     []byte
+	modified time.Time
+}
+
+func (o fakeS3Object) etag() string {
+	hash := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(hash[:]) + `"`
+}
+
+// fakeS3 emulates a single bucket, with the path-style requests for the operations used by S3Sync
+type fakeS3 struct {
+	mtx     sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []fakeS3ListEntry
+}
+
+type fakeS3ListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if r.URL.Path == "/"+testS3Bucket+"/" && r.Method == http.MethodGet {
+		prefix := r.URL.Query().Get("prefix")
+		res := fakeS3ListResult{Name: testS3Bucket, Prefix: prefix}
+		for key, obj := range f.objects {
+			if strings.HasPrefix(key, prefix) {
+				res.Contents = append(res.Contents, fakeS3ListEntry{Key: key, ETag: obj.etag(), Size: len(obj.data),
+					LastModified: obj.modified.UTC().Format(time.RFC3339)})
+			}
+		}
+		res.KeyCount = len(res.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(res)
+		return
+	}
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testS3Bucket+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj := fakeS3Object{data: data, modified: time.Now()}
+		f.objects[key] = obj
+		w.Header().Set("ETag", obj.etag())
+	case http.MethodGet, http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+			return
+		}
+		w.Header().Set("ETag", obj.etag())
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(obj.data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *minio.Client) {
+	fake := &fakeS3{objects: make(map[string]fakeS3Object)}
+	srv := httptest.NewTLSServer(fake)
+	t.Cleanup(srv.Close)
+
+	endpoint, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4("access", "secret", ""),
+		Secure:       true,
+		Transport:    srv.Client().Transport,
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, client
+}
+
+func TestS3Sync(t *testing.T) {
+	fake, client := newFakeS3(t)
+	ctx := context.Background()
+
+	rootDir := t.TempDir()
+	fullPath := filepath.Join(rootDir, "img/a.png")
+	writeTestImage(t, fullPath)
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := LocalImage{fullPath: fullPath, relPath: "img/a.png", mediaType: "image/png", size: int64(len(data))}
+
+	uploader := NewS3Sync(client, testS3Bucket, "blog", rootDir, testImageUrlRoot)
+	err = uploader.BuildImageMap(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgUrl, err := uploader.EnsureLocalImageIsUploaded(ctx, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imgUrl != testImageUrlRoot+"/img/a.png" {
+		t.Errorf("unexpected URL: %s", imgUrl)
+	}
+	if obj, ok := fake.objects["blog/img/a.png"]; !ok || !bytes.Equal(obj.data, data) {
+		t.Fatalf("the image is not uploaded under the prefix: %v", fake.objects)
+	}
+
+	// The listing finds the uploaded image, and its ETag matches the local file and the in-memory copy
+	otherRoot := t.TempDir()
+	s := NewS3Sync(client, testS3Bucket, "blog/", otherRoot, testImageUrlRoot)
+	err = s.BuildImageMap(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosted := s.HostedImages()
+	if len(hosted) != 1 || hosted[0].Name != "img/a.png" || hosted[0].Url != imgUrl {
+		t.Fatalf("unexpected hosted images: %+v", hosted)
+	}
+	if _, ok := s.FindUploadedImage(img); !ok {
+		t.Error("the uploaded image is not found")
+	}
+	if _, ok := s.FindUploadedImage(LocalImage{relPath: "img/a.png", size: img.size, data: data}); !ok {
+		t.Error("the uploaded image is not found by its contents")
+	}
+	changed := append([]byte{}, data...)
+	changed[len(changed)-1] ^= 0xff
+	if _, ok := s.FindUploadedImage(LocalImage{relPath: "img/a.png", size: img.size, data: changed}); ok {
+		t.Error("the changed image is considered uploaded")
+	}
+
+	relPath, err := s.DownloadAndSaveImage(ctx, imgUrl, "2024-01-02", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := os.ReadFile(filepath.Join(otherRoot, relPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relPath != "img/a.png" || !bytes.Equal(downloaded, data) {
+		t.Errorf("unexpected download: %s", relPath)
+	}
+
+	err = s.DeleteHostedImage(ctx, hosted[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 || len(s.HostedImages()) != 0 {
+		t.Errorf("the image is not deleted: %v", fake.objects)
+	}
+}
+
+func TestS3SyncDownloadMissing(t *testing.T) {
+	_, client := newFakeS3(t)
+	s := NewS3Sync(client, testS3Bucket, "blog", t.TempDir(), testImageUrlRoot)
+
+	_, err := s.DownloadAndSaveImage(context.Background(), testImageUrlRoot+"/missing.png", "2024-01-02", "hello")
+	if err == nil {
+		t.Error("the missing image is downloaded")
+	}
+	if retryable, _ := ClassifyError(err); retryable {
+		t.Errorf("the missing image is retried: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/snapas/go-snapas"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+const snapasCacheFileName = "snapas-photos.json"
+
+// snapasCacheMaxAge is how long the cached listing is updated incrementally. The incremental updates only see
+// the new photos, so the photos deleted outside writeas-sync are noticed after the next full listing.
+const snapasCacheMaxAge = 24 * time.Hour
+
+// snapasPhotoCache is the Snap.As photo listing saved between the runs, the newest photos first
+type snapasPhotoCache struct {
+	// ETag of the first page of the listing
+	ETag string `json:"etag"`
+	// Listed is the time of the last full listing
+	Listed time.Time      `json:"listed"`
+	Photos []snapas.Photo `json:"photos"`
+}
+
+func snapasCachePath(rootDir string) string {
+	return path.Join(rootDir, SyncStateDir, snapasCacheFileName)
+}
+
+// loadSnapasCache reads the cached listing, it's nil if there's no cache yet
+func loadSnapasCache(rootDir string) (*snapasPhotoCache, error) {
+	data, err := os.ReadFile(snapasCachePath(rootDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &snapasPhotoCache{}
+	err = json.Unmarshal(data, cache)
+	if err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (s *snapasPhotoCache) Save(rootDir string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomically(snapasCachePath(rootDir), 0644, time.Time{}, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// isFresh checks if the cache can be updated incrementally
+func (s *snapasPhotoCache) isFresh() bool {
+	return s != nil && time.Since(s.Listed) < snapasCacheMaxAge
+}
+
+// remove drops the deleted photo from the cache
+func (s *snapasPhotoCache) remove(photoID string) {
+	for i, p := range s.Photos {
+		if p.ID == photoID {
+			s.Photos = append(s.Photos[:i], s.Photos[i+1:]...)
+			return
+		}
+	}
+}
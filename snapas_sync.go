@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/snapas/go-snapas"
 	"io"
@@ -11,6 +12,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 const SnapAsUrlPrefix = "https://i.snap.as/"
@@ -22,31 +25,157 @@ const DirectorySeparatorReplacement = "¦"
 const ObsidianSyncPrefix = "¬"
 
 type SnapasSync struct {
-	rootDir                string
-	client                 *snapas.Client
+	rootDir string
+	client  *snapas.Client
+	// album is the alias of the Snap.as album with the blog images, empty for the account root
+	album string
+
+	// cache is the photo listing saved between the runs
+	cache *snapasPhotoCache
+	// ReadOnly doesn't save the updated listing, it's used for planning
+	ReadOnly bool
+	// FullListing ignores the cached listing, so the photos deleted outside writeas-sync are not listed
+	FullListing bool
+
+	// Guards the photo maps, they are updated by the parallel transfers
+	mtx                    sync.RWMutex
 	imageMapByUrl          map[string]snapas.Photo
 	imageMapByFilenameName map[string]snapas.Photo
 }
 
 var _ ImageSyncer = &SnapasSync{}
 
-func NewSnapasSync(client *snapas.Client, rootDir string) *SnapasSync {
+func NewSnapasSync(client *snapas.Client, rootDir string, album string) *SnapasSync {
 	return &SnapasSync{
 		client:                 client,
 		rootDir:                rootDir,
+		album:                  album,
 		imageMapByUrl:          make(map[string]snapas.Photo),
 		imageMapByFilenameName: make(map[string]snapas.Photo),
 	}
 }
 
-func (c *SnapasSync) BuildImageMap() error {
+func (c *SnapasSync) Backend() string {
+	if c.album != "" {
+		return "snapas:" + c.album
+	}
+	return "snapas"
+}
+
+// SupportsMediaType allows only the images, Snap.As can't host the other files
+func (c *SnapasSync) SupportsMediaType(mediaType string) bool {
+	return isWebImage(mediaType)
+}
+
+// inAlbum checks if the photo belongs to the configured album, all photos belong to the account root
+func (c *SnapasSync) inAlbum(p snapas.Photo) bool {
+	return c.album == "" || (p.Album != nil && p.Album.Alias == c.album)
+}
+
+// listPhotos enumerates the photos page by page. The cached listing is reused if it hasn't been modified, or
+// it's extended with the photos uploaded since it was saved: the listing stops at the newest cached photo.
+func (c *SnapasSync) listPhotos(ctx context.Context) ([]snapas.Photo, error) {
+	cache, err := loadSnapasCache(c.rootDir)
+	if err != nil {
+		slog.Default().Warn("Ignoring the broken Snap.As photo cache", "error", err)
+		cache = nil
+	}
+	if !cache.isFresh() || c.FullListing {
+		cache = nil
+	}
+
+	etag := ""
+	known := make(map[string]bool)
+	if cache != nil {
+		etag = cache.ETag
+		for _, p := range cache.Photos {
+			known[p.ID] = true
+		}
+	}
+
+	type listedPage struct {
+		photos      []snapas.Photo
+		etag        string
+		notModified bool
+	}
+
 	var photos []snapas.Photo
-	_, err := c.client.Get("/me/photos", &photos)
+	seen := make(map[string]bool)
+	newEtag := ""
+	reachedCache := false
+	for page := 1; !reachedCache; page++ {
+		res, err := ReqWithRetries[listedPage](ctx, func() (listedPage, error) {
+			ifNoneMatch := ""
+			if page == 1 {
+				ifNoneMatch = etag
+			}
+			pagePhotos, pageEtag, notModified, err := ListPhotos(ctx, c.client, page, ifNoneMatch)
+			return listedPage{photos: pagePhotos, etag: pageEtag, notModified: notModified}, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if res.notModified {
+			slog.Default().Info("The Snap.As photo listing is not modified, using the cache")
+			c.cache = cache
+			return cache.Photos, nil
+		}
+		if page == 1 {
+			newEtag = res.etag
+		}
+
+		added := 0
+		for _, p := range res.photos {
+			if known[p.ID] {
+				reachedCache = true
+				break
+			}
+			if !seen[p.ID] {
+				seen[p.ID] = true
+				photos = append(photos, p)
+				added++
+			}
+		}
+		// The pages are exhausted, or the server doesn't support the paging and returned the same photos again
+		if added == 0 {
+			break
+		}
+	}
+
+	listed := time.Now()
+	if reachedCache {
+		for _, p := range cache.Photos {
+			if !seen[p.ID] {
+				photos = append(photos, p)
+			}
+		}
+		listed = cache.Listed
+	}
+
+	c.cache = &snapasPhotoCache{ETag: newEtag, Listed: listed, Photos: photos}
+	if c.ReadOnly {
+		return photos, nil
+	}
+	err = c.cache.Save(c.rootDir)
+	if err != nil {
+		slog.Default().Warn("Failed to save the Snap.As photo cache", "error", err)
+	}
+	return photos, nil
+}
+
+func (c *SnapasSync) BuildImageMap(ctx context.Context) error {
+	photos, err := c.listPhotos(ctx)
 	if err != nil {
 		return err
 	}
 
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	for _, p := range photos {
+		if !c.inAlbum(p) {
+			continue
+		}
+
 		// We can't depend on the size reported by the API
 		// TODO: we don't need this for now, because we gave up on size validation
 		//resp, err := http.Head(p.URL)
@@ -64,12 +193,18 @@ func (c *SnapasSync) BuildImageMap() error {
 	return nil
 }
 
-func (c *SnapasSync) EnsureLocalImageIsUploaded(img LocalImage) (string, error) {
+func encodeSnapAsFilename(relPath string) string {
+	return ObsidianSyncPrefix + strings.ReplaceAll(relPath, "/", DirectorySeparatorReplacement)
+}
+
+func (c *SnapasSync) FindUploadedImage(img LocalImage) (string, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
 	// Check if the image is already present first by the filename
-	escapedName := ObsidianSyncPrefix + strings.ReplaceAll(img.relPath, "/", DirectorySeparatorReplacement)
-	cur, ok := c.imageMapByFilenameName[escapedName]
+	cur, ok := c.imageMapByFilenameName[encodeSnapAsFilename(img.relPath)]
 	if ok {
-		return cur.URL, nil
+		return cur.URL, true
 		//TODO: size comparison doesn't work because snap.as does image reprocessing.
 		//Leave this for now, until they have true as-is storage.
 		//if cur.Size == img.size {
@@ -83,7 +218,7 @@ func (c *SnapasSync) EnsureLocalImageIsUploaded(img LocalImage) (string, error)
 	// use the filename as the URL
 	cur, ok = c.imageMapByUrl[SnapAsUrlPrefix+path.Base(img.fullPath)]
 	if ok {
-		return cur.URL, nil
+		return cur.URL, true
 		//TODO: size comparison doesn't work because snap.as does image reprocessing.
 		//Leave this for now, until they have true as-is storage.
 		//if cur.Size == img.size {
@@ -93,16 +228,34 @@ func (c *SnapasSync) EnsureLocalImageIsUploaded(img LocalImage) (string, error)
 		//	img.fullPath, cur.URL)
 	}
 
+	return "", false
+}
+
+func (c *SnapasSync) EnsureLocalImageIsUploaded(ctx context.Context, img LocalImage) (string, error) {
+	if imgUrl, ok := c.FindUploadedImage(img); ok {
+		return imgUrl, nil
+	}
+
 	// Nope, image was not found so upload it
+	return c.UploadImage(ctx, img)
+}
+
+// UploadImage uploads a new photo, the previous photo with the same name is kept on Snap.As, because
+// the posts might still reference it
+func (c *SnapasSync) UploadImage(ctx context.Context, img LocalImage) (string, error) {
 	slog.Default().Warn("Uploading a new image", slog.String("file", img.relPath))
-	photo, err := UploadPhoto(c.client, img.fullPath, escapedName)
+	photo, err := ReqWithRetries[*snapas.Photo](ctx, func() (*snapas.Photo, error) {
+		return UploadPhoto(ctx, c.client, img.fullPath, encodeSnapAsFilename(img.relPath), c.album)
+	})
 	if err != nil {
 		return "", err
 	}
 
 	photo.Size = img.size // The API is broken, it reports incorrect file sizes
+	c.mtx.Lock()
 	c.imageMapByFilenameName[photo.Filename] = *photo
 	c.imageMapByUrl[photo.URL] = *photo
+	c.mtx.Unlock()
 
 	return photo.URL, nil
 }
@@ -121,7 +274,8 @@ func IsSubPath(parent, sub string) (bool, error) {
 	return false, nil
 }
 
-func (c *SnapasSync) DownloadAndSaveImage(fullImageUrl string, datePart string, slug string) (string, error) {
+// resolveDownloadPath finds the local path for the remote image, it's empty for the images not hosted on Snap.As
+func (c *SnapasSync) resolveDownloadPath(fullImageUrl string, datePart string, slug string) (string, error) {
 	// Check if image is relative to the post
 	if !strings.HasPrefix(fullImageUrl, SnapAsUrlPrefix) {
 		return "", nil
@@ -132,23 +286,16 @@ func (c *SnapasSync) DownloadAndSaveImage(fullImageUrl string, datePart string,
 		return "", err
 	}
 
+	c.mtx.RLock()
 	existing, ok := c.imageMapByUrl[fullImageUrl]
+	c.mtx.RUnlock()
 	// For images from other SnapAs accounts or for images that don't have an encoded path, we just
-	// download them into the default location.
+	// download them into the default location. The album images are kept together, mirroring the album.
 	if !ok || !strings.HasPrefix(existing.Filename, ObsidianSyncPrefix) {
-		fileDir := datePart + "-" + slug
-		err := os.MkdirAll(path.Join(c.rootDir, fileDir), 0755)
-		if err != nil {
-			return "", err
+		if ok && c.album != "" {
+			return c.albumImagePath(path.Base(imgUrl.Path))
 		}
-		imgName := path.Base(imgUrl.Path)
-
-		relPath := path.Join(fileDir, imgName)
-		slog.Default().Info("Downloading image",
-			slog.String("url", existing.URL), slog.String("dest", relPath))
-
-		err = c.doDownloadImage(path.Join(c.rootDir, fileDir, imgName), fullImageUrl)
-		return relPath, err
+		return path.Join(datePart+"-"+slug, path.Base(imgUrl.Path)), nil
 	}
 
 	// This is our image, download it into a custom path
@@ -160,15 +307,41 @@ func (c *SnapasSync) DownloadAndSaveImage(fullImageUrl string, datePart string,
 		return "", fmt.Errorf("failed to sanitize the path: %w", err)
 	}
 
+	return sanitizedRelPath, nil
+}
+
+// albumImagePath places the album image into the directory named after the album
+func (c *SnapasSync) albumImagePath(fileName string) (string, error) {
+	sanitizedRelPath, err := EnsurePathIsRelativeToItsLocation(path.Join(c.album, fileName), false)
+	if err != nil || sanitizedRelPath == "" {
+		return "", fmt.Errorf("failed to sanitize the path: %w", err)
+	}
+	return sanitizedRelPath, nil
+}
+
+func (c *SnapasSync) PlanImageDownload(fullImageUrl string, datePart string, slug string) (string, bool, error) {
+	relPath, err := c.resolveDownloadPath(fullImageUrl, datePart, slug)
+	if err != nil || relPath == "" {
+		return "", false, err
+	}
+
+	_, err = os.Stat(path.Join(c.rootDir, relPath))
+	return relPath, err != nil, nil
+}
+
+func (c *SnapasSync) DownloadAndSaveImage(ctx context.Context, fullImageUrl string, datePart string, slug string) (string, error) {
+	sanitizedRelPath, err := c.resolveDownloadPath(fullImageUrl, datePart, slug)
+	if err != nil || sanitizedRelPath == "" {
+		return "", err
+	}
+
 	sanitizedAbsPath := path.Join(c.rootDir, sanitizedRelPath)
 
 	// Just return the current path, if it exists
-	if ok {
-		_, err = os.Stat(sanitizedAbsPath)
-		if err == nil {
-			slog.Default().Info("The image already exists", slog.String("dest", sanitizedAbsPath))
-			return sanitizedRelPath, nil
-		}
+	_, err = os.Stat(sanitizedAbsPath)
+	if err == nil {
+		slog.Default().Info("The image already exists", slog.String("dest", sanitizedAbsPath))
+		return sanitizedRelPath, nil
 	}
 
 	sanitizedAbsDir := path.Dir(sanitizedAbsPath)
@@ -181,9 +354,11 @@ func (c *SnapasSync) DownloadAndSaveImage(fullImageUrl string, datePart string,
 	}
 
 	slog.Default().Info("Downloading image",
-		slog.String("url", existing.URL), slog.String("dest", sanitizedAbsPath))
+		slog.String("url", fullImageUrl), slog.String("dest", sanitizedAbsPath))
 
-	err = c.doDownloadImage(sanitizedAbsPath, existing.URL)
+	_, err = ReqWithRetries[bool](ctx, func() (bool, error) {
+		return true, c.doDownloadImage(ctx, sanitizedAbsPath, fullImageUrl)
+	})
 	if err != nil {
 		return "", err
 	}
@@ -191,26 +366,18 @@ func (c *SnapasSync) DownloadAndSaveImage(fullImageUrl string, datePart string,
 	return sanitizedRelPath, nil
 }
 
-func (c *SnapasSync) doDownloadImage(dstFile string, url string) error {
+func (c *SnapasSync) doDownloadImage(ctx context.Context, dstFile string, url string) error {
 	_, err := os.Stat(dstFile)
 	if err == nil {
 		// File already exists, nothing to do
 		return nil
 	}
 
-	dirName, _ := path.Split(dstFile)
-	err = os.MkdirAll(dirName, 0755)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
-
-	out, err := os.Create(dstFile)
-	if err != nil {
-		return err
-	}
-	defer func() { _ = out.Close() }()
-
-	resp, err := http.Get(url)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -218,14 +385,53 @@ func (c *SnapasSync) doDownloadImage(dstFile string, url string) error {
 
 	// Check server response
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+		return NewHttpStatusError(resp, "failed to download "+url)
 	}
 
-	// Writer the body to file
-	_, err = io.Copy(out, resp.Body)
+	// Writer the body to file, nothing is left behind if the download fails or is cancelled
+	return WriteFileAtomically(dstFile, 0644, time.Time{}, func(w io.Writer) error {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	})
+}
+
+func (c *SnapasSync) HostedImages() []HostedImage {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	var res []HostedImage
+	for _, photo := range c.imageMapByUrl {
+		name := ""
+		if strings.HasPrefix(photo.Filename, ObsidianSyncPrefix) {
+			name = strings.ReplaceAll(strings.TrimPrefix(photo.Filename, ObsidianSyncPrefix),
+				DirectorySeparatorReplacement, "/")
+		}
+		res = append(res, HostedImage{Url: photo.URL, Name: name, Created: photo.Created, id: photo.ID})
+	}
+	return res
+}
+
+func (c *SnapasSync) DeleteHostedImage(ctx context.Context, img HostedImage) error {
+	_, err := ReqWithRetries[bool](ctx, func() (bool, error) {
+		return true, DeletePhoto(ctx, c.client, img.id)
+	})
 	if err != nil {
 		return err
 	}
 
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.cache != nil {
+		c.cache.remove(img.id)
+		err = c.cache.Save(c.rootDir)
+		if err != nil {
+			slog.Default().Warn("Failed to save the Snap.As photo cache", "error", err)
+		}
+	}
+	photo := c.imageMapByUrl[img.Url]
+	delete(c.imageMapByUrl, img.Url)
+	if cur, ok := c.imageMapByFilenameName[photo.Filename]; ok && cur.ID == photo.ID {
+		delete(c.imageMapByFilenameName, photo.Filename)
+	}
 	return nil
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/snapas/go-snapas"
+)
+
+// fakeSnapas serves the photo listing, two photos per page, the newest first
+type fakeSnapas struct {
+	mtx    sync.Mutex
+	photos []snapas.Photo
+	// requests are the listed pages, "304" is appended to the page number if it's not modified
+	requests []string
+}
+
+func (f *fakeSnapas) etag() string {
+	var ids []string
+	for _, p := range f.photos {
+		ids = append(ids, p.ID)
+	}
+	return `"` + strings.Join(ids, ",") + `"`
+}
+
+func (f *fakeSnapas) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if r.URL.Path != "/me/photos" {
+		http.NotFound(w, r)
+		return
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		http.Error(w, "invalid page", http.StatusBadRequest)
+		return
+	}
+	if page == 1 && r.Header.Get("If-None-Match") == f.etag() {
+		f.requests = append(f.requests, "1-304")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	f.requests = append(f.requests, strconv.Itoa(page))
+
+	photos := []snapas.Photo{}
+	if start := (page - 1) * 2; start < len(f.photos) {
+		photos = f.photos[start:min(start+2, len(f.photos))]
+	}
+	w.Header().Set("ETag", f.etag())
+	_ = json.NewEncoder(w).Encode(map[string]any{"code": http.StatusOK, "data": photos})
+}
+
+func (f *fakeSnapas) add(ids ...string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var added []snapas.Photo
+	for _, id := range ids {
+		added = append(added, snapas.Photo{ID: id, URL: SnapAsUrlPrefix + id + ".png", Filename: id + ".png"})
+	}
+	f.photos = append(added, f.photos...)
+}
+
+func (f *fakeSnapas) takeRequests() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	res := f.requests
+	f.requests = nil
+	return res
+}
+
+func newFakeSnapas(t *testing.T) (*fakeSnapas, *snapas.Client) {
+	fake := &fakeSnapas{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	client := snapas.NewClient("token")
+	client.Config.BaseURL = srv.URL
+	return fake, client
+}
+
+func TestSnapasListPhotos(t *testing.T) {
+	fake, client := newFakeSnapas(t)
+	fake.add("p1", "p2", "p3", "p4", "p5")
+	rootDir := t.TempDir()
+	ctx := context.Background()
+
+	list := func(fullListing bool) []string {
+		t.Helper()
+		s := NewSnapasSync(client, rootDir, "")
+		s.FullListing = fullListing
+		photos, err := s.listPhotos(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, p := range photos {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	steps := []struct {
+		name         string
+		add          []string
+		fullListing  bool
+		want         []string
+		wantRequests []string
+	}{
+		{name: "all pages", want: []string{"p1", "p2", "p3", "p4", "p5"},
+			wantRequests: []string{"1", "2", "3", "4"}},
+		{name: "not modified", want: []string{"p1", "p2", "p3", "p4", "p5"}, wantRequests: []string{"1-304"}},
+		{name: "incremental", add: []string{"n1", "n2"}, want: []string{"n1", "n2", "p1", "p2", "p3", "p4", "p5"},
+			wantRequests: []string{"1", "2"}},
+		{name: "full listing", fullListing: true, want: []string{"n1", "n2", "p1", "p2", "p3", "p4", "p5"},
+			wantRequests: []string{"1", "2", "3", "4", "5"}},
+	}
+	for _, step := range steps {
+		fake.add(step.add...)
+		got := list(step.fullListing)
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+		if requests := fake.takeRequests(); !reflect.DeepEqual(requests, step.wantRequests) {
+			t.Errorf("%s: unexpected requests %v, want %v", step.name, requests, step.wantRequests)
+		}
+	}
+
+	// The stale cache is not used
+	cache, err := loadSnapasCache(rootDir)
+	if err != nil || cache == nil {
+		t.Fatalf("the cache is not saved: %v", err)
+	}
+	cache.Listed = time.Now().Add(-snapasCacheMaxAge - time.Minute)
+	err = cache.Save(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list(false)
+	if requests := fake.takeRequests(); len(requests) != 5 {
+		t.Errorf("the stale cache is used: %v", requests)
+	}
+}
+
+func TestSnapasListPhotosReadOnly(t *testing.T) {
+	fake, client := newFakeSnapas(t)
+	for i := 0; i < 3; i++ {
+		fake.add(fmt.Sprintf("p%d", i))
+	}
+	rootDir := t.TempDir()
+
+	s := NewSnapasSync(client, rootDir, "")
+	s.ReadOnly = true
+	photos, err := s.listPhotos(context.Background())
+	if err != nil || len(photos) != 3 {
+		t.Fatalf("unexpected photos: %v, %v", photos, err)
+	}
+	if cache, err := loadSnapasCache(rootDir); cache != nil || err != nil {
+		t.Errorf("the cache is saved in the read-only mode: %v", err)
+	}
+}
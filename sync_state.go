@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/writeas/go-writeas/v2"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyncStateDir is the directory (relative to the blog root) that holds the synchronization state
+const SyncStateDir = ".writeas-sync"
+
+const syncStateFileName = "state.json"
+
+// PostSyncState describes a post as it was at the end of the last successful synchronization
+type PostSyncState struct {
+	RemoteID      string    `json:"remote_id"`
+	RemoteUpdated time.Time `json:"remote_updated"`
+	RemoteHash    string    `json:"remote_hash"`
+	LocalHash     string    `json:"local_hash"`
+	// File is the path of the post file relative to the blog root
+	File string `json:"file,omitempty"`
+	// Base is the local content of the post as of the last sync, used for the three-way merges
+	Base string `json:"base"`
+	// Images are the hashes of the post images, keyed by their paths relative to the blog root
+	Images map[string]string `json:"images,omitempty"`
+}
+
+// SyncState is the persistent synchronization manifest, keyed by the post slug
+type SyncState struct {
+	Posts map[string]PostSyncState `json:"posts"`
+	// Images is the index of the uploaded images, keyed by their paths relative to the blog root
+	Images map[string]ImageSyncState `json:"images,omitempty"`
+}
+
+type PostChange int
+
+const (
+	PostUnchanged PostChange = iota
+	PostChangedLocally
+	PostChangedRemotely
+	PostChangedOnBothSides
+)
+
+func (c PostChange) String() string {
+	switch c {
+	case PostUnchanged:
+		return "unchanged"
+	case PostChangedLocally:
+		return "changed locally"
+	case PostChangedRemotely:
+		return "changed remotely"
+	case PostChangedOnBothSides:
+		return "changed on both sides"
+	}
+	return "unknown"
+}
+
+func ContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// remoteHashPrefix marks the hashes that cover the post metadata, the hashes recorded by the older versions cover
+// only the title and the content
+const remoteHashPrefix = "v2:"
+
+// RemotePostHash hashes the parts of the remote post that we synchronize: the title, the content and the metadata
+func RemotePostHash(post writeas.Post) string {
+	lang := ""
+	if post.Language != nil {
+		lang = *post.Language
+	}
+	rtl := ""
+	if post.RTL != nil {
+		rtl = strconv.FormatBool(*post.RTL)
+	}
+	tags := slices.Clone(post.Tags)
+	sort.Strings(tags)
+
+	parts := []string{post.Title, post.Content, post.Font, lang, rtl, post.Created.UTC().Format(time.RFC3339),
+		strings.Join(tags, ",")}
+	return remoteHashPrefix + ContentHash(strings.Join(parts, "\x00"))
+}
+
+// RemotePostMatchesHash checks if the remote post is the same as the one with the recorded hash
+func RemotePostMatchesHash(post writeas.Post, hash string) bool {
+	if !strings.HasPrefix(hash, remoteHashPrefix) {
+		// Recorded by an older version, the metadata changes are picked up after the next sync
+		return ContentHash(post.Title+"\x00"+post.Content) == hash
+	}
+	return RemotePostHash(post) == hash
+}
+
+func syncStatePath(rootDir string) string {
+	return path.Join(rootDir, SyncStateDir, syncStateFileName)
+}
+
+// LoadSyncState reads the state manifest from the blog root. A missing manifest results in an empty state.
+func LoadSyncState(rootDir string) (*SyncState, error) {
+	state := &SyncState{
+		Posts:  make(map[string]PostSyncState),
+		Images: make(map[string]ImageSyncState),
+	}
+
+	data, err := os.ReadFile(syncStatePath(rootDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Posts == nil {
+		state.Posts = make(map[string]PostSyncState)
+	}
+	if state.Images == nil {
+		state.Images = make(map[string]ImageSyncState)
+	}
+
+	return state, nil
+}
+
+func (s *SyncState) Save(rootDir string) error {
+	err := os.MkdirAll(path.Join(rootDir, SyncStateDir), 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomically(syncStatePath(rootDir), 0644, time.Time{}, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// RecordSynced remembers the post as being identical on both sides
+func (s *SyncState) RecordSynced(slug string, localContent string, remote writeas.Post) {
+	s.Posts[slug] = PostSyncState{
+		RemoteID:      remote.ID,
+		RemoteUpdated: remote.Updated,
+		RemoteHash:    RemotePostHash(remote),
+		LocalHash:     ContentHash(localContent),
+		Base:          localContent,
+	}
+}
+
+// ClassifyChange determines which side of the post has changed since the last synchronization. The
+// second return value is false if the post has never been synchronized.
+func (s *SyncState) ClassifyChange(local LocalPost, remote writeas.Post) (PostChange, bool) {
+	st, ok := s.Posts[local.slug]
+	if !ok || st.RemoteID != remote.ID {
+		return PostUnchanged, false
+	}
+
+	localChanged := ContentHash(local.content) != st.LocalHash
+	remoteChanged := !RemotePostMatchesHash(remote, st.RemoteHash)
+
+	if localChanged && remoteChanged {
+		return PostChangedOnBothSides, true
+	} else if localChanged {
+		return PostChangedLocally, true
+	} else if remoteChanged {
+		return PostChangedRemotely, true
+	}
+	return PostUnchanged, true
+}
+
+// ClassifyChangeByMtime is the fallback for posts that have no recorded state, it compares the timestamps
+func ClassifyChangeByMtime(local LocalPost, remote writeas.Post) PostChange {
+	timeDiff := local.mtime.Sub(remote.Updated)
+	if timeDiff > AllowedFileTimestampSkew {
+		// The file is substantially newer than the server's post
+		return PostChangedLocally
+	} else if timeDiff < -AllowedFileTimestampSkew {
+		return PostChangedRemotely
+	}
+	return PostUnchanged
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/writeas/go-writeas/v2"
+)
+
+func testRemotePost() writeas.Post {
+	lang, rtl := "en", false
+	return writeas.Post{ID: "id-hello", Slug: "hello", Title: "Hello", Content: "Text\n", Font: "serif",
+		Language: &lang, RTL: &rtl, Created: time.Date(2024, 1, 2, 8, 30, 0, 0, time.UTC),
+		Updated: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), Tags: []string{"go", "sync"}}
+}
+
+func TestRemotePostHash(t *testing.T) {
+	base := RemotePostHash(testRemotePost())
+
+	changes := map[string]func(post *writeas.Post){
+		"title":   func(post *writeas.Post) { post.Title = "Bye" },
+		"content": func(post *writeas.Post) { post.Content = "Other text\n" },
+		"font":    func(post *writeas.Post) { post.Font = "mono" },
+		"lang":    func(post *writeas.Post) { lang := "de"; post.Language = &lang },
+		"rtl":     func(post *writeas.Post) { rtl := true; post.RTL = &rtl },
+		"no rtl":  func(post *writeas.Post) { post.RTL = nil },
+		"created": func(post *writeas.Post) { post.Created = post.Created.Add(time.Hour) },
+		"tags":    func(post *writeas.Post) { post.Tags = []string{"go"} },
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			post := testRemotePost()
+			change(&post)
+			if RemotePostHash(post) == base {
+				t.Error("the change is not detected")
+			}
+		})
+	}
+
+	// The server-side fields that we don't synchronize are ignored
+	post := testRemotePost()
+	post.Updated = post.Updated.Add(time.Hour)
+	post.Views = 42
+	post.Tags = []string{"sync", "go"}
+	if RemotePostHash(post) != base {
+		t.Error("the unsynchronized fields change the hash")
+	}
+}
+
+func TestRemotePostMatchesHash(t *testing.T) {
+	post := testRemotePost()
+	if !RemotePostMatchesHash(post, RemotePostHash(post)) {
+		t.Error("the post doesn't match its hash")
+	}
+
+	// The hashes recorded by the older versions cover only the title and the content
+	legacy := ContentHash(post.Title + "\x00" + post.Content)
+	post.Font = "mono"
+	if !RemotePostMatchesHash(post, legacy) {
+		t.Error("the post doesn't match the legacy hash")
+	}
+	post.Content = "Other text\n"
+	if RemotePostMatchesHash(post, legacy) {
+		t.Error("the changed post matches the legacy hash")
+	}
+}
+
+func TestClassifyChange(t *testing.T) {
+	const content = "---\ntitle: Hello\n---\nText\n"
+	local := LocalPost{slug: "hello", content: content}
+
+	tests := []struct {
+		name       string
+		local      string
+		remote     func(post *writeas.Post)
+		want       PostChange
+		wantSynced bool
+	}{
+		{name: "unchanged", local: content, want: PostUnchanged, wantSynced: true},
+		{name: "local", local: content + "More\n", want: PostChangedLocally, wantSynced: true},
+		{name: "remote content", local: content, remote: func(post *writeas.Post) { post.Content = "Other\n" },
+			want: PostChangedRemotely, wantSynced: true},
+		{name: "remote metadata", local: content, remote: func(post *writeas.Post) { post.Font = "mono" },
+			want: PostChangedRemotely, wantSynced: true},
+		{name: "both", local: content + "More\n", remote: func(post *writeas.Post) { post.Title = "Bye" },
+			want: PostChangedOnBothSides, wantSynced: true},
+		{name: "replaced remotely", local: content, remote: func(post *writeas.Post) { post.ID = "id-other" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &SyncState{Posts: make(map[string]PostSyncState)}
+			state.RecordSynced("hello", content, testRemotePost())
+
+			remote := testRemotePost()
+			if tt.remote != nil {
+				tt.remote(&remote)
+			}
+			local.content = tt.local
+			change, synced := state.ClassifyChange(local, remote)
+			if change != tt.want || synced != tt.wantSynced {
+				t.Errorf("got %s, %t", change, synced)
+			}
+		})
+	}
+
+	state := &SyncState{Posts: make(map[string]PostSyncState)}
+	if _, synced := state.ClassifyChange(local, testRemotePost()); synced {
+		t.Error("the post is never synchronized, but it's classified by the state")
+	}
+}
+
+func TestClassifyChangeByMtime(t *testing.T) {
+	remote := testRemotePost()
+
+	tests := []struct {
+		name  string
+		mtime time.Time
+		want  PostChange
+	}{
+		{name: "same", mtime: remote.Updated, want: PostUnchanged},
+		{name: "within the skew", mtime: remote.Updated.Add(AllowedFileTimestampSkew / 2), want: PostUnchanged},
+		{name: "local newer", mtime: remote.Updated.Add(time.Minute), want: PostChangedLocally},
+		{name: "remote newer", mtime: remote.Updated.Add(-time.Minute), want: PostChangedRemotely},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyChangeByMtime(LocalPost{mtime: tt.mtime}, remote); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
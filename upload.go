@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/snapas/go-snapas"
@@ -12,9 +13,9 @@ import (
 	"os"
 )
 
-// UploadPhoto uploads a photo, and returns a Snap.as Photo. See:
-// https://developers.snap.as/docs/api/#upload-a-photo
-func UploadPhoto(client *snapas.Client, fileName, fileTag string) (*snapas.Photo, error) {
+// UploadPhoto uploads a photo into the album (or into the account root if it's empty), and returns a
+// Snap.as Photo. See: https://developers.snap.as/docs/api/#upload-a-photo
+func UploadPhoto(ctx context.Context, client *snapas.Client, fileName, fileTag, album string) (*snapas.Photo, error) {
 	f, err := os.Open(fileName)
 	if err != nil {
 		return nil, fmt.Errorf("open file: %s", err)
@@ -32,13 +33,19 @@ func UploadPhoto(client *snapas.Client, fileName, fileTag string) (*snapas.Photo
 	if err != nil {
 		return nil, fmt.Errorf("copy file: %s", err)
 	}
+	if album != "" {
+		err = w.WriteField("album", album)
+		if err != nil {
+			return nil, fmt.Errorf("write album field: %s", err)
+		}
+	}
 	err = w.Close()
 	if err != nil {
 		return nil, fmt.Errorf("close writer: %s", err)
 	}
 
 	url := fmt.Sprintf("%s%s", client.Config.BaseURL, "/photos/upload")
-	req, err := http.NewRequest("POST", url, body)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return nil, fmt.Errorf("create request: %s", err)
 	}
@@ -48,7 +55,7 @@ func UploadPhoto(client *snapas.Client, fileName, fileTag string) (*snapas.Photo
 
 	resp, err := client.Config.Client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request: %s", err)
+		return nil, fmt.Errorf("request: %w", err)
 	}
 	defer func() { _ = resp.Body.Close() }()
 
@@ -57,12 +64,78 @@ func UploadPhoto(client *snapas.Client, fileName, fileTag string) (*snapas.Photo
 		Data: &snapas.Photo{},
 	}
 	err = json.NewDecoder(resp.Body).Decode(&env)
+	if resp.StatusCode != http.StatusCreated {
+		return nil, NewHttpStatusError(resp, "failed to upload the photo: "+env.ErrorMessage)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if env.Code != http.StatusCreated {
-		return nil, fmt.Errorf("%s", env.ErrorMessage)
-	}
 
 	return env.Data.(*snapas.Photo), nil
 }
+
+// DeletePhoto deletes the photo from Snap.as. See:
+// https://developers.snap.as/docs/api/#delete-a-photo
+func DeletePhoto(ctx context.Context, client *snapas.Client, photoID string) error {
+	url := fmt.Sprintf("%s/photos/%s", client.Config.BaseURL, photoID)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %s", err)
+	}
+	req.Header.Add("User-Agent", client.Config.UserAgent)
+	req.Header.Add("Authorization", client.Token)
+
+	resp, err := client.Config.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return NewHttpStatusError(resp, "failed to delete the photo "+photoID)
+	}
+
+	return nil
+}
+
+// ListPhotos retrieves a page of the user's photos, the newest first. The page parameter is 1-based, once the
+// pages are exhausted, the returned slice is empty. If the etag is not empty and the listing hasn't changed,
+// notModified is true and no photos are returned.
+func ListPhotos(ctx context.Context, client *snapas.Client, page int, etag string) (photos []snapas.Photo,
+	newEtag string, notModified bool, err error) {
+
+	url := fmt.Sprintf("%s/me/photos?page=%d", client.Config.BaseURL, page)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("create request: %s", err)
+	}
+	req.Header.Add("User-Agent", client.Config.UserAgent)
+	req.Header.Add("Authorization", client.Token)
+	if etag != "" {
+		req.Header.Add("If-None-Match", etag)
+	}
+
+	resp, err := client.Config.Client.Do(req)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", false, NewHttpStatusError(resp, "failed to list the photos")
+	}
+
+	env := &impart.Envelope{
+		Code: resp.StatusCode,
+		Data: &photos,
+	}
+	err = json.NewDecoder(resp.Body).Decode(&env)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	return photos, resp.Header.Get("ETag"), false, nil
+}
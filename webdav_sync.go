@@ -1,53 +1,46 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/studio-b12/gowebdav"
 	"io"
 	"log/slog"
-	"net/url"
 	"os"
 	"path"
-	"strings"
 	"time"
 )
 
-type RemoteImage struct {
-	Url   string
-	Mtime time.Time
-	Size  int64
-}
-
 type WebDAVSync struct {
-	rootDir       string
-	remoteUrlRoot string
-
+	*prefixHosting
 	client *gowebdav.Client
-
-	fileMap map[string]RemoteImage
 }
 
 var _ ImageSyncer = &WebDAVSync{}
 
 func NewWebDAVSync(client *gowebdav.Client, rootDir, remoteUrlRoot string) *WebDAVSync {
 	return &WebDAVSync{
+		prefixHosting: newPrefixHosting(rootDir, remoteUrlRoot),
 		client:        client,
-		rootDir:       rootDir,
-		remoteUrlRoot: remoteUrlRoot,
-		fileMap:       make(map[string]RemoteImage),
 	}
 }
 
-func (w *WebDAVSync) BuildImageMap() error {
-	err := w.readList("")
+func (w *WebDAVSync) Backend() string {
+	return "webdav:" + w.remoteUrlRoot
+}
+
+func (w *WebDAVSync) BuildImageMap(ctx context.Context) error {
+	err := w.readList(ctx, "")
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (w *WebDAVSync) readList(curRelPath string) error {
-	fileInfos, err := w.client.ReadDir(curRelPath)
+func (w *WebDAVSync) readList(ctx context.Context, curRelPath string) error {
+	fileInfos, err := ReqWithRetries[[]os.FileInfo](ctx, func() ([]os.FileInfo, error) {
+		return w.client.ReadDir(curRelPath)
+	})
 	if err != nil {
 		return err
 	}
@@ -59,86 +52,76 @@ func (w *WebDAVSync) readList(curRelPath string) error {
 			if err != nil {
 				return fmt.Errorf("DANGER! Received a malicious filename from WebDAV: %s", dirName)
 			}
-			err = w.readList(path.Join(curRelPath, dirName))
+			err = w.readList(ctx, path.Join(curRelPath, dirName))
 			if err != nil {
 				return err
 			}
 		} else {
-			w.fileMap[path.Join(curRelPath, fi.Name())] = RemoteImage{
-				Url:   path.Join(curRelPath, fi.Name()),
+			relPath := path.Join(curRelPath, fi.Name())
+			imgUrl, err := w.imageUrl(relPath)
+			if err != nil {
+				return err
+			}
+			w.setImage(relPath, RemoteImage{
+				Url:   imgUrl,
 				Mtime: fi.ModTime(),
 				Size:  fi.Size(),
-			}
+			})
 		}
 	}
 
 	return nil
 }
 
-func (w *WebDAVSync) EnsureLocalImageIsUploaded(img LocalImage) (string, error) {
-	// Check if we already have this image
-	if remoteImg, ok := w.fileMap[img.relPath]; ok {
-		// Check if it's the same image
-		if remoteImg.Size == img.size && !remoteImg.Mtime.Before(img.mtime) {
-			return remoteImg.Url, nil
-		}
+func (w *WebDAVSync) EnsureLocalImageIsUploaded(ctx context.Context, img LocalImage) (string, error) {
+	if imgUrl, ok := w.FindUploadedImage(img); ok {
+		return imgUrl, nil
 	}
+	return w.UploadImage(ctx, img)
+}
 
+func (w *WebDAVSync) UploadImage(ctx context.Context, img LocalImage) (string, error) {
 	slog.Default().Info("Uploading new or changed local image", slog.String("path", img.relPath),
 		slog.String("name", img.fullPath), slog.Int64("size", img.size))
 
-	file, _ := os.Open(img.fullPath)
-	defer func() { _ = file.Close() }()
-
-	webDavPath, err := url.JoinPath(w.remoteUrlRoot, img.relPath)
+	webDavPath, err := w.imageUrl(img.relPath)
 	if err != nil {
 		return "", err
 	}
 
-	err = w.client.WriteStream(img.relPath, file, 0644)
+	_, err = ReqWithRetries[bool](ctx, func() (bool, error) {
+		// Reopen the file for each attempt, the previous one might have consumed it
+		file, err := os.Open(img.fullPath)
+		if err != nil {
+			return false, err
+		}
+		defer func() { _ = file.Close() }()
+		return true, w.client.WriteStream(img.relPath, file, 0644)
+	})
 	if err != nil {
 		return "", err
 	}
 
-	w.fileMap[img.fullPath] = RemoteImage{
+	w.setImage(img.relPath, RemoteImage{
 		Url:   webDavPath,
 		Mtime: img.mtime,
 		Size:  img.size,
-	}
+	})
 
 	slog.Default().Info("Uploaded local image", slog.String("url", webDavPath))
 
 	return webDavPath, nil
 }
 
-func (w *WebDAVSync) DownloadAndSaveImage(fullImageUrl string, postDatePart string, postSlug string) (string, error) {
-	// Check if image is relative to the post
-	if !strings.HasPrefix(fullImageUrl, w.remoteUrlRoot) {
-		return "", nil
-	}
-
-	relPath := strings.TrimPrefix(fullImageUrl, w.remoteUrlRoot)
-	relPath = strings.TrimPrefix(relPath, "/")
-
-	sanitizedRelPath, err := EnsurePathIsRelativeToItsLocation(relPath, false)
+func (w *WebDAVSync) DownloadAndSaveImage(ctx context.Context, fullImageUrl string, postDatePart string, postSlug string) (string, error) {
+	sanitizedRelPath, err := w.resolveDownloadPath(fullImageUrl)
 	if err != nil || sanitizedRelPath == "" {
-		return "", fmt.Errorf("failed to sanitize the path: %w", err)
+		return "", err
 	}
 
-	existing, ok := w.fileMap[relPath]
-	if ok {
-		localFile, err := os.Stat(path.Join(w.rootDir, sanitizedRelPath))
-		if err == nil {
-			if localFile.Size() == existing.Size {
-				slog.Default().Info("The image already exists", slog.String("dest", sanitizedRelPath))
-				return sanitizedRelPath, nil
-			}
-			if localFile.ModTime().After(existing.Mtime) {
-				slog.Default().Info("The local image is newer, skipping the download",
-					slog.String("dest", sanitizedRelPath))
-				return sanitizedRelPath, nil
-			}
-		}
+	if current, msg := w.isLocalImageCurrent(sanitizedRelPath); current {
+		slog.Default().Info(msg, slog.String("dest", sanitizedRelPath))
+		return sanitizedRelPath, nil
 	}
 
 	slog.Default().Info("Downloading image", slog.String("dest", sanitizedRelPath))
@@ -154,55 +137,66 @@ func (w *WebDAVSync) DownloadAndSaveImage(fullImageUrl string, postDatePart stri
 		}
 	}
 
-	stat, err := w.client.Stat(relPath)
+	stat, err := ReqWithRetries[os.FileInfo](ctx, func() (os.FileInfo, error) {
+		return w.client.Stat(sanitizedRelPath)
+	})
 	if err != nil {
 		return "", err
 	}
 
-	err = w.doDownload(sanitizedAbsPath, sanitizedRelPath, stat.ModTime())
+	_, err = ReqWithRetries[bool](ctx, func() (bool, error) {
+		return true, w.doDownload(ctx, sanitizedAbsPath, sanitizedRelPath, stat.ModTime())
+	})
 	if err != nil {
 		return "", err
 	}
 
 	slog.Default().Info("Downloaded the image", slog.String("dest", sanitizedRelPath))
 
-	w.fileMap[relPath] = RemoteImage{
+	w.setImage(sanitizedRelPath, RemoteImage{
 		Url:   fullImageUrl,
 		Mtime: stat.ModTime(),
 		Size:  stat.Size(),
-	}
+	})
 
 	return sanitizedRelPath, nil
 }
 
-func (w *WebDAVSync) doDownload(absFilePath string, relPath string, mtime time.Time) error {
+func (w *WebDAVSync) doDownload(ctx context.Context, absFilePath string, relPath string, mtime time.Time) error {
 	reader, err := w.client.ReadStream(relPath)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = reader.Close() }()
 
-	file, err := os.Create(absFilePath)
-	if err != nil {
+	// The WebDAV client doesn't support the cancellation, so at least check it between the reads
+	return WriteFileAtomically(absFilePath, 0644, mtime, func(w io.Writer) error {
+		_, err := io.Copy(w, &contextReader{ctx: ctx, reader: reader})
 		return err
-	}
-	defer func() {
-		if file != nil {
-			_ = file.Close()
-		}
-	}()
+	})
+}
 
-	_, err = io.Copy(file, reader)
-	if err != nil {
-		return err
-	}
+// contextReader stops reading once the context is cancelled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
 
-	_ = file.Close()
-	file = nil
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
 
-	err = os.Chtimes(absFilePath, time.Time{}, mtime)
+func (w *WebDAVSync) DeleteHostedImage(ctx context.Context, img HostedImage) error {
+	_, err := ReqWithRetries[bool](ctx, func() (bool, error) {
+		return true, w.client.Remove(img.id)
+	})
 	if err != nil {
 		return err
 	}
 
+	w.removeImage(img.id)
 	return nil
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+// countingHandler counts the requests by their method
+type countingHandler struct {
+	handler http.Handler
+
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+func (c *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	c.counts[r.Method]++
+	c.mtx.Unlock()
+	c.handler.ServeHTTP(w, r)
+}
+
+func (c *countingHandler) count(method string) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.counts[method]
+}
+
+func newFakeWebDAV(t *testing.T) (*countingHandler, *gowebdav.Client) {
+	handler := &countingHandler{
+		handler: &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()},
+		counts:  make(map[string]int),
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return handler, gowebdav.NewClient(srv.URL, "", "")
+}
+
+func TestWebDAVSyncImageMap(t *testing.T) {
+	const urlRoot = "https://img.example.com/blog"
+	server, client := newFakeWebDAV(t)
+
+	rootDir := t.TempDir()
+	fullPath := filepath.Join(rootDir, "img", "a.png")
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(fullPath, []byte("image data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := LocalImage{fullPath: fullPath, relPath: "img/a.png", size: 10, mtime: time.Now().Add(-time.Hour)}
+
+	ctx := context.Background()
+
+	uploader := NewWebDAVSync(client, rootDir, urlRoot)
+	for i := 0; i < 2; i++ {
+		imgUrl, err := uploader.EnsureLocalImageIsUploaded(ctx, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imgUrl != urlRoot+"/img/a.png" {
+			t.Errorf("unexpected URL: %s", imgUrl)
+		}
+	}
+	if puts := server.count(http.MethodPut); puts != 1 {
+		t.Errorf("the uploaded image is not remembered, %d uploads", puts)
+	}
+
+	// The listed images are found by their paths, and they have the full URLs
+	otherRoot := t.TempDir()
+	w := NewWebDAVSync(client, otherRoot, urlRoot)
+	err = w.BuildImageMap(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgUrl, err := w.EnsureLocalImageIsUploaded(ctx, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imgUrl != urlRoot+"/img/a.png" || server.count(http.MethodPut) != 1 {
+		t.Errorf("the listed image is not found: %s", imgUrl)
+	}
+
+	for i := 0; i < 2; i++ {
+		relPath, err := w.DownloadAndSaveImage(ctx, urlRoot+"/img/a.png", "2024-01-02", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if relPath != "img/a.png" {
+			t.Errorf("unexpected path: %s", relPath)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(otherRoot, "img", "a.png"))
+	if err != nil || string(data) != "image data" {
+		t.Errorf("the image is not downloaded: %q, %v", data, err)
+	}
+	if gets := server.count(http.MethodGet); gets != 1 {
+		t.Errorf("the downloaded image is downloaded again, %d downloads", gets)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/snapas/go-snapas"
 	"github.com/spf13/cobra"
@@ -8,32 +9,69 @@ import (
 	"github.com/writeas/go-writeas/v2"
 	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func doSync(conv ImageSyncer, ps *PostSynchronizer, doDownload, doUpload bool) error {
+// loadSyncInputs retrieves the local and remote state, without changing anything
+func loadSyncInputs(ctx context.Context, conv ImageSyncer, ps *PostSynchronizer) ([]writeas.Post, error) {
 	slog.Default().Info("Retrieving remote image names")
-	err := conv.BuildImageMap()
+	err := conv.BuildImageMap(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	slog.Default().Info("Enumerating local posts", slog.String("rootDir", ps.rootDir))
 	err = ps.FindFiles()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	slog.Default().Info("Found local posts", slog.Int("num", len(ps.posts)))
 
+	err = ps.LoadState()
+	if err != nil {
+		return nil, err
+	}
+
 	slog.Default().Info("Fetching the remote posts")
-	remotePosts, err := ps.LoadRemotePosts()
+	remotePosts, err := ps.LoadRemotePosts(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	slog.Default().Info("Found remote posts", slog.Int("num", len(remotePosts)))
 
+	slog.Default().Info("Fetching the remote drafts")
+	remoteDrafts, err := ps.LoadRemoteDrafts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slog.Default().Info("Found remote drafts", slog.Int("num", len(remoteDrafts)))
+	remotePosts = append(remotePosts, remoteDrafts...)
+
+	return remotePosts, nil
+}
+
+// logSkippedDeletions warns about the deletions that are not propagated in this direction
+func logSkippedDeletions(ps *PostSynchronizer, remotePosts []writeas.Post, doDownload, doUpload bool) {
+	for _, act := range ps.SkippedDeletions(remotePosts, doDownload, doUpload) {
+		slog.Default().Warn("The deletion is not propagated by the one-way sync, run the full sync",
+			slog.String("slug", act.Slug), slog.String("reason", act.Reason))
+	}
+}
+
+func doSync(ctx context.Context, conv ImageSyncer, ps *PostSynchronizer, doDownload, doUpload bool) error {
+	remotePosts, err := loadSyncInputs(ctx, conv, ps)
+	if err != nil {
+		return err
+	}
+	logSkippedDeletions(ps, remotePosts, doDownload, doUpload)
+
 	if doDownload {
 		slog.Default().Info("Downloading new or changed remote posts")
-		err = ps.UpdateOrCreateLocalPosts(remotePosts)
+		actions := ps.ConfirmDeletions(ps.PlanLocalUpdates(remotePosts), "local")
+		err = saveStateAfter(ps, ps.UpdateOrCreateLocalPosts(ctx, actions))
 		if err != nil {
 			return err
 		}
@@ -41,44 +79,159 @@ func doSync(conv ImageSyncer, ps *PostSynchronizer, doDownload, doUpload bool) e
 
 	if doUpload {
 		slog.Default().Info("Uploading new or changed images")
-		imageMap, err := ps.UploadLocalImages()
+		imageMap, err := ps.UploadLocalImages(ctx)
 		if err != nil {
 			return err
 		}
 
 		slog.Default().Info("Uploading new or changed local posts")
-		err = ps.UpdateOrCreateRemotePosts(remotePosts, imageMap)
+		actions := ps.ConfirmDeletions(ps.PlanRemoteUpdates(remotePosts), "remote")
+		err = saveStateAfter(ps, ps.UpdateOrCreateRemotePosts(ctx, actions, imageMap))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveStateAfter saves the state even if the synchronization has failed or has been cancelled midway, so
+// that the already synchronized posts are not seen as changed during the next run
+func saveStateAfter(ps *PostSynchronizer, syncErr error) error {
+	err := ps.SaveState()
+	if syncErr != nil {
+		return syncErr
+	}
+	return err
+}
+
+// doPlan prints what doSync is going to do, without making any changes locally or remotely
+func doPlan(ctx context.Context, conv ImageSyncer, ps *PostSynchronizer, doDownload, doUpload bool) error {
+	remotePosts, err := loadSyncInputs(ctx, conv, ps)
+	if err != nil {
+		return err
+	}
+	logSkippedDeletions(ps, remotePosts, doDownload, doUpload)
+
+	plan := &SyncPlan{}
+	if doDownload {
+		plan.LocalPosts = ps.PlanLocalUpdates(remotePosts)
+		plan.ImageDownloads, err = ps.PlanImageDownloads(plan.LocalPosts)
 		if err != nil {
 			return err
 		}
 	}
 
+	if doUpload {
+		// Note that the posts merged during the download are uploaded as well
+		plan.ImageUploads, err = ps.PlanImageUploads()
+		if err != nil {
+			return err
+		}
+		plan.RemotePosts = ps.PlanRemoteUpdates(remotePosts)
+	}
+
+	plan.Print(os.Stdout)
 	return nil
 }
 
+// runSync either performs the synchronization or prints its plan
+func runSync(ctx context.Context, conv ImageSyncer, ps *PostSynchronizer, doDownload, doUpload, dryRun bool) error {
+	if dryRun {
+		return doPlan(ctx, conv, ps, doDownload, doUpload)
+	}
+	return doSync(ctx, conv, ps, doDownload, doUpload)
+}
+
 type Application struct {
-	conv ImageSyncer
-	ps   *PostSynchronizer
+	alias string
+	conv  ImageSyncer
+	ps    *PostSynchronizer
 }
 
 type Settings struct {
-	Alias         string
-	RootDirectory string
-	Login         string
-	Password      string
+	BlogSettings
+
+	// BlogsFile lists the blogs to synchronize, instead of the single blog from BlogSettings
+	BlogsFile string
+	// Blogs are listed directly in the configuration file
+	Blogs []BlogSettings
 
-	ImageHostingType string
-	ImageLogin       string
-	ImagePassword    string
+	Login    string
+	Password string
+	Token    string
 
-	WebDavEndpoint string
-	WebDavImageUrl string
+	// CredentialHelper is the command that stores the access token, instead of the credentials file
+	CredentialHelper string
 
 	SnapAsEndpoint  string
 	WriteAsEndpoint string
+
+	DryRun         bool
+	AllowDelete    bool
+	ArchiveDeleted bool
+	AssumeYes      bool
+
+	Include []string
+	Exclude []string
+	Layout  string
+
+	// Jobs is the number of the parallel image transfers
+	Jobs int
+	// MediaTypes are the extensions of the referenced files that are synchronized
+	MediaTypes []string
+
+	ImageProcessing ImageProcessingOptions
+	// KeepExif publishes the images with their metadata, it's removed by default
+	KeepExif bool
+
+	MaxAttempts   int
+	RetryDeadline time.Duration
+	// Timeout limits the duration of the whole run
+	Timeout time.Duration
+
+	// fullImageListing ignores the cached listings of the hosted images
+	fullImageListing bool
+
+	// Where each of the settings came from, and the configuration files that have been checked
+	sources     map[string]string
+	configFiles []string
+}
+
+// logIn authenticates with the token from the settings, or with the stored token, falling back to the password
+func logIn(sets *Settings) (*writeas.Client, string, error) {
+	writeAsClient := writeas.NewClientWith(writeas.Config{
+		URL: sets.WriteAsEndpoint,
+	})
+
+	if sets.Token != "" {
+		writeAsClient.SetToken(sets.Token)
+		return writeAsClient, sets.Token, nil
+	}
+
+	token, err := NewTokenStore(sets.CredentialHelper).Get(sets.WriteAsEndpoint)
+	if err != nil {
+		return nil, "", err
+	}
+	if token != "" {
+		writeAsClient.SetToken(token)
+		_, err = writeAsClient.GetMe(false)
+		if err == nil {
+			return writeAsClient, token, nil
+		}
+		if sets.Password == "" {
+			return nil, "", fmt.Errorf("the stored token is no longer valid, use the login command: %w", err)
+		}
+		slog.Default().Warn("The stored token is no longer valid, using the password", "error", err)
+	}
+
+	if sets.Password == "" {
+		return nil, "", fmt.Errorf("not logged in: use the login command, or specify the token or the password")
+	}
+	return passwordLogIn(sets)
 }
 
-func initApp(sets *Settings) (*Application, error) {
+func passwordLogIn(sets *Settings) (*writeas.Client, string, error) {
 	writeAsClient := writeas.NewClientWith(writeas.Config{
 		URL: sets.WriteAsEndpoint,
 	})
@@ -86,35 +239,151 @@ func initApp(sets *Settings) (*Application, error) {
 	slog.Default().Info("Logging into Write.as")
 	user, err := writeAsClient.LogIn(sets.Login, sets.Password)
 	if err != nil {
-		return nil, fmt.Errorf("failed to login: %w", err)
+		return nil, "", fmt.Errorf("failed to login: %w", err)
 	}
 
 	writeAsClient.SetToken(user.AccessToken)
-	snapAsClient := snapas.NewClient(user.AccessToken)
+	return writeAsClient, user.AccessToken, nil
+}
 
+func initApp(sets *Settings, blog BlogSettings, writeAsClient *writeas.Client, token string,
+	drafts draftAssignment) (*Application, error) {
 	var conv ImageSyncer
 
-	if sets.ImageHostingType == "webdav" {
-		client := gowebdav.NewClient(sets.WebDavEndpoint, sets.ImageLogin, sets.ImagePassword)
-		err = client.Connect()
+	switch blog.ImageHostingType {
+	case "webdav":
+		client := gowebdav.NewClient(blog.WebDavEndpoint, blog.ImageLogin, blog.ImagePassword)
+		err := client.Connect()
 		if err != nil {
 			return nil, fmt.Errorf("failed to connect to WebDAV: %w", err)
 		}
-		conv = NewWebDAVSync(client, sets.RootDirectory, sets.WebDavImageUrl)
-	} else if sets.ImageHostingType == "snapas" {
-		conv = NewSnapasSync(snapAsClient, sets.RootDirectory)
-	} else {
-		panic("invalid image hosting type")
+		conv = NewWebDAVSync(client, blog.RootDirectory, blog.WebDavImageUrl)
+	case "s3":
+		client, err := NewS3Client(S3Settings{
+			Endpoint:  blog.S3Endpoint,
+			Bucket:    blog.S3Bucket,
+			Prefix:    blog.S3Prefix,
+			Region:    blog.S3Region,
+			PathStyle: blog.S3PathStyle,
+			AccessKey: blog.S3AccessKey,
+			SecretKey: blog.S3SecretKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		conv = NewS3Sync(client, blog.S3Bucket, blog.S3Prefix, blog.RootDirectory, blog.S3ImageUrl)
+	case "filesystem":
+		conv = NewFilesystemSync(blog.RootDirectory, blog.FsImageDir, blog.FsImageUrl)
+	case "snapas":
+		snapasSync := NewSnapasSync(snapas.NewClient(token), blog.RootDirectory, blog.SnapAsAlbum)
+		snapasSync.ReadOnly = sets.DryRun
+		snapasSync.FullListing = sets.fullImageListing
+		conv = snapasSync
+	default:
+		return nil, fmt.Errorf("invalid image hosting type: %s", blog.ImageHostingType)
 	}
-
-	ps := NewPostSynchronizer(conv, writeAsClient, sets.RootDirectory, sets.Alias)
+	processing := NewProcessingImageSyncer(conv, blog.RootDirectory, sets.ImageProcessing)
+	processing.ReadOnly = sets.DryRun
+	conv = processing
+
+	ps := NewPostSynchronizer(conv, writeAsClient, blog.RootDirectory, blog.Alias, SyncOptions{
+		AllowDelete:    sets.AllowDelete,
+		ArchiveDeleted: sets.ArchiveDeleted,
+		AssumeYes:      sets.AssumeYes,
+		Include:        sets.Include,
+		Exclude:        sets.Exclude,
+		Layout:         sets.Layout,
+		Jobs:           sets.Jobs,
+		ClaimedDrafts:  drafts.claimed,
+		SkipNewDrafts:  !drafts.takeNew,
+	})
 
 	return &Application{
-		conv: conv,
-		ps:   ps,
+		alias: blog.Alias,
+		conv:  conv,
+		ps:    ps,
 	}, nil
 }
 
+// draftAssignment selects the drafts that a blog synchronizes, see SyncOptions.ClaimedDrafts
+type draftAssignment struct {
+	claimed map[string]bool
+	takeNew bool
+}
+
+// claimedDrafts collects the remote IDs of the posts recorded in the sync states of the blogs. It's only
+// needed if there's more than one blog.
+func claimedDrafts(blogs []BlogSettings) (map[string]bool, error) {
+	if len(blogs) < 2 {
+		return nil, nil
+	}
+	claimed := make(map[string]bool)
+	for _, blog := range blogs {
+		state, err := LoadSyncState(blog.RootDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the sync state of the blog %s: %w", blog.Alias, err)
+		}
+		for _, st := range state.Posts {
+			if st.RemoteID != "" {
+				claimed[st.RemoteID] = true
+			}
+		}
+	}
+	return claimed, nil
+}
+
+// forEachBlog logs in once and runs the command for every configured blog. A failure in one blog doesn't
+// stop the others, the failures are reported at the end.
+func forEachBlog(ctx context.Context, sets *Settings, cmd func(app *Application) error) error {
+	blogs, err := sets.ResolveBlogs()
+	if err != nil {
+		return err
+	}
+
+	writeAsClient, token, err := logIn(sets)
+	if err != nil {
+		return err
+	}
+
+	claimed, err := claimedDrafts(blogs)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for i, blog := range blogs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logger := slog.Default().With(slog.String("alias", blog.Alias), slog.String("root", blog.RootDirectory))
+		if len(blogs) > 1 {
+			logger.Info("Processing the blog")
+			fmt.Printf("Blog %s (%s):\n", blog.Alias, blog.RootDirectory)
+		}
+
+		app, err := initApp(sets, blog, writeAsClient, token, draftAssignment{claimed: claimed, takeNew: i == 0})
+		if err == nil {
+			err = cmd(app)
+		}
+		if err != nil {
+			if len(blogs) == 1 {
+				return err
+			}
+			logger.Error("Blog failed", "error", err)
+			failed = append(failed, blog.Alias)
+			continue
+		}
+		if len(blogs) > 1 {
+			logger.Info("Blog done")
+		}
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("%d of %d blogs failed: %s", len(failed), len(blogs), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
 func main() {
 	var rootCmd = &cobra.Command{
 		Use:   "writeas-sync",
@@ -130,47 +399,133 @@ func main() {
 	}
 
 	rootCmd.PersistentFlags().StringVarP(&setts.Alias, "alias", "a",
-		os.Getenv("WRITEAS_ALIAS"), "Write.as alias")
+		"", "Write.as alias")
 	rootCmd.PersistentFlags().StringVarP(&setts.RootDirectory, "root", "r",
 		wd, "Root directory of your blog")
+	rootCmd.PersistentFlags().StringVarP(&setts.BlogsFile, "blogs", "", "",
+		"YAML file with the list of blogs to synchronize, overrides the --alias and --root")
 
-	rootCmd.PersistentFlags().StringVarP(&setts.Login, "login", "l", os.Getenv("WRITEAS_LOGIN"),
+	rootCmd.PersistentFlags().StringVarP(&setts.Login, "login", "l", "",
 		"Write.as login")
 	rootCmd.PersistentFlags().StringVarP(&setts.Password, "password", "p", "",
 		"Write.as password (uses WRITEAS_PASS environment variable if not specified)")
-	cobra.OnInitialize(func() {
-		if setts.Password == "" {
-			setts.Password = os.Getenv("WRITEAS_PASS")
-		}
-		if setts.ImageLogin == "" {
-			setts.ImageLogin = setts.Login
-		}
-		if setts.ImagePassword == "" {
-			setts.ImagePassword = setts.Password
-		}
-	})
+
+	rootCmd.PersistentFlags().StringVarP(&setts.Token, "token", "", "",
+		"Write.as access token, the token stored by the login command is used if not specified")
+	rootCmd.PersistentFlags().StringVarP(&setts.CredentialHelper, "credential-helper", "", "",
+		"Command that stores the access token, instead of the "+CredentialsFileName+" file")
 
 	rootCmd.PersistentFlags().StringVarP(&setts.ImageHostingType, "image-hosting-type", "t",
-		"snapas", "Image hosting type: snapas (default), webdav")
+		"snapas", "Image hosting type: snapas (default), webdav, s3, filesystem")
 
 	rootCmd.PersistentFlags().StringVarP(&setts.ImageLogin, "image-login", "i", "",
 		"Image hosting login, the same as WriteAs login if not specified")
 	rootCmd.PersistentFlags().StringVarP(&setts.ImagePassword, "image-password", "v", "",
 		"Image hosting password, the same as WriteAs password if not specified")
 
+	rootCmd.PersistentFlags().StringVarP(&setts.SnapAsAlbum, "snapas-album", "", "",
+		"Snap.as album for the blog images, the account root if not specified")
+
 	rootCmd.PersistentFlags().StringVarP(&setts.WebDavEndpoint, "webdav-endpoint", "",
-		os.Getenv("WRITEAS_WEBDAV_URL"), "WebDAV endpoint URL")
+		"", "WebDAV endpoint URL")
 	rootCmd.PersistentFlags().StringVarP(&setts.WebDavImageUrl, "webdav-published-url", "",
-		os.Getenv("WRITEAS_WEBDAV_PUBLISHED_URL"), "URL for publicly accessible WebDAV images")
+		"", "URL for publicly accessible WebDAV images")
+
+	rootCmd.PersistentFlags().StringVarP(&setts.S3Endpoint, "s3-endpoint", "",
+		"", "S3 API endpoint URL, e.g.: https://s3.eu-central-1.amazonaws.com")
+	rootCmd.PersistentFlags().StringVarP(&setts.S3Bucket, "s3-bucket", "",
+		"", "S3 bucket for the images")
+	rootCmd.PersistentFlags().StringVarP(&setts.S3Prefix, "s3-prefix", "",
+		"", "Prefix of the image keys in the S3 bucket")
+	rootCmd.PersistentFlags().StringVarP(&setts.S3Region, "s3-region", "",
+		"", "S3 region, detected automatically if not specified")
+	rootCmd.PersistentFlags().BoolVarP(&setts.S3PathStyle, "s3-path-style", "", false,
+		"Use the path-style S3 URLs (required by MinIO and some other S3-compatible servers)")
+	rootCmd.PersistentFlags().StringVarP(&setts.S3ImageUrl, "s3-published-url", "",
+		"", "URL for publicly accessible S3 images (corresponding to the prefix)")
+	rootCmd.PersistentFlags().StringVarP(&setts.S3AccessKey, "s3-access-key", "",
+		"", "S3 access key, taken from the AWS environment variables or credentials file if not specified")
+	rootCmd.PersistentFlags().StringVarP(&setts.S3SecretKey, "s3-secret-key", "",
+		"", "S3 secret key")
+
+	rootCmd.PersistentFlags().StringVarP(&setts.FsImageDir, "fs-image-dir", "",
+		"", "Directory to copy the images into, for the filesystem image hosting")
+	rootCmd.PersistentFlags().StringVarP(&setts.FsImageUrl, "fs-published-url", "",
+		"", "URL for publicly accessible images in the filesystem image directory")
 
 	rootCmd.PersistentFlags().StringVarP(&setts.SnapAsEndpoint, "snapas-endpoint", "s",
 		"https://snap.as/api", "Snap.as API endpoint")
 	rootCmd.PersistentFlags().StringVarP(&setts.WriteAsEndpoint, "writeas-endpoint", "w",
 		"https://write.as/api", "Write.as API endpoint")
 
+	rootCmd.PersistentFlags().BoolVarP(&setts.DryRun, "dry-run", "n", false,
+		"Print the planned changes without making them")
+	rootCmd.PersistentFlags().BoolVarP(&setts.AllowDelete, "allow-delete", "", false,
+		"Propagate the deletions of the previously synchronized posts")
+	rootCmd.PersistentFlags().BoolVarP(&setts.ArchiveDeleted, "archive-deleted", "", false,
+		"Move the posts deleted on the server into the "+ArchiveDir+" directory instead of deleting them")
+	rootCmd.PersistentFlags().BoolVarP(&setts.AssumeYes, "yes", "y", false,
+		"Do not ask for the confirmation of the deletions")
+
+	rootCmd.PersistentFlags().StringSliceVarP(&setts.Include, "include", "", nil,
+		"Globs of the post files to synchronize (relative to the root directory), all posts if not specified")
+	rootCmd.PersistentFlags().StringSliceVarP(&setts.Exclude, "exclude", "", nil,
+		"Globs of the files and directories to skip, in addition to the ones in "+IgnoreFileName)
+	rootCmd.PersistentFlags().StringVarP(&setts.Layout, "layout", "", DefaultPostLayout,
+		"Template for the paths of the newly downloaded posts, e.g.: {{.Year}}/{{.Date}}-{{.Slug}}.md")
+
+	rootCmd.PersistentFlags().IntVarP(&setts.Jobs, "jobs", "j", DefaultJobs,
+		"Number of the images to upload or download in parallel")
+	rootCmd.PersistentFlags().StringSliceVarP(&setts.MediaTypes, "media-types", "", DefaultMediaTypes,
+		"Extensions of the referenced images and attachments to synchronize")
+	rootCmd.PersistentFlags().IntVarP(&setts.ImageProcessing.MaxDimension, "image-max-size", "", 0,
+		"Downsize the larger images to fit into this many pixels before the upload (no resizing by default)")
+	rootCmd.PersistentFlags().IntVarP(&setts.ImageProcessing.Quality, "image-quality", "", 0,
+		"Re-encode the JPEG images with this quality (1-100) and the PNG images with the best compression")
+	rootCmd.PersistentFlags().BoolVarP(&setts.KeepExif, "keep-exif", "", false,
+		"Upload the images with their EXIF (including the GPS location), XMP and IPTC metadata")
+	rootCmd.PersistentFlags().IntVarP(&setts.MaxAttempts, "max-attempts", "", DefaultRetryPolicy.MaxAttempts,
+		"Maximum number of attempts for the failed requests")
+	rootCmd.PersistentFlags().DurationVarP(&setts.RetryDeadline, "retry-deadline", "", DefaultRetryPolicy.Deadline,
+		"Maximum time to spend on retrying a request")
+	rootCmd.PersistentFlags().DurationVarP(&setts.Timeout, "timeout", "", 0,
+		"Maximum duration of the whole run, e.g.: 10m (no limit by default)")
+
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
-		if setts.ImageHostingType != "webdav" && setts.ImageHostingType != "snapas" {
-			return fmt.Errorf("invalid image hosting type: %s", setts.ImageHostingType)
+		err := ResolveConfig(cmd.Flags(), setts)
+		if err != nil {
+			return err
+		}
+		if setts.Jobs < 1 {
+			return fmt.Errorf("the number of jobs must be positive")
+		}
+		err = SetMediaTypes(setts.MediaTypes)
+		if err != nil {
+			return err
+		}
+		setts.ImageProcessing.StripMetadata = !setts.KeepExif
+		if setts.ImageProcessing.MaxDimension < 0 {
+			return fmt.Errorf("the maximum image size must not be negative")
+		}
+		if setts.ImageProcessing.Quality < 0 || setts.ImageProcessing.Quality > 100 {
+			return fmt.Errorf("the image quality must be between 1 and 100")
+		}
+		if setts.MaxAttempts < 1 {
+			return fmt.Errorf("the maximum number of attempts must be positive")
+		}
+		retryPolicy.MaxAttempts = setts.MaxAttempts
+		retryPolicy.Deadline = setts.RetryDeadline
+
+		if setts.Timeout > 0 {
+			ctx, cancel := context.WithTimeout(cmd.Context(), setts.Timeout)
+			cobra.OnFinalize(cancel)
+			cmd.SetContext(ctx)
+		}
+		if setts.ImageLogin == "" {
+			setts.ImageLogin = setts.Login
+		}
+		if setts.ImagePassword == "" {
+			setts.ImagePassword = setts.Password
 		}
 		return nil
 	}
@@ -179,11 +534,9 @@ func main() {
 		Use:   "sync",
 		Short: "Synchronize your blog (upload and download)",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			app, err := initApp(setts)
-			if err != nil {
-				return err
-			}
-			return doSync(app.conv, app.ps, true, true)
+			return forEachBlog(cmd.Context(), setts, func(app *Application) error {
+				return runSync(cmd.Context(), app.conv, app.ps, true, true, setts.DryRun)
+			})
 		},
 	}
 
@@ -191,11 +544,9 @@ func main() {
 		Use:   "upload",
 		Short: "Push your local changes to the remote blog",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			app, err := initApp(setts)
-			if err != nil {
-				return err
-			}
-			return doSync(app.conv, app.ps, false, true)
+			return forEachBlog(cmd.Context(), setts, func(app *Application) error {
+				return runSync(cmd.Context(), app.conv, app.ps, false, true, setts.DryRun)
+			})
 		},
 	}
 
@@ -203,17 +554,123 @@ func main() {
 		Use:   "download",
 		Short: "Pull remote changes to your local blog",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			app, err := initApp(setts)
+			return forEachBlog(cmd.Context(), setts, func(app *Application) error {
+				return runSync(cmd.Context(), app.conv, app.ps, true, false, setts.DryRun)
+			})
+		},
+	}
+
+	planCmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Show what the synchronization is going to do, without changing anything",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// The plan doesn't update the local caches either
+			setts.DryRun = true
+			return forEachBlog(cmd.Context(), setts, func(app *Application) error {
+				return doPlan(cmd.Context(), app.conv, app.ps, true, true)
+			})
+		},
+	}
+
+	gcOpts := GcOptions{}
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "List the hosted images that are not referenced by any post, and delete them with --apply",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			gcOpts.DryRun = setts.DryRun
+			// The cached listing might still have the images deleted outside writeas-sync
+			setts.fullImageListing = true
+			return forEachBlog(cmd.Context(), setts, func(app *Application) error {
+				return doGc(cmd.Context(), app.conv, app.ps, gcOpts, os.Stdout)
+			})
+		},
+	}
+	gcCmd.Flags().BoolVarP(&gcOpts.Apply, "apply", "", false,
+		"Delete the unreferenced images, instead of just listing them")
+	gcCmd.Flags().DurationVarP(&gcOpts.GracePeriod, "grace-period", "", DefaultGcGracePeriod,
+		"Keep the images uploaded within this period")
+	gcCmd.Flags().StringSliceVarP(&gcOpts.Protect, "protect", "", nil,
+		"Never delete the images with the URL or the path starting with this prefix (can be repeated)")
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	configCmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "Print the effective configuration and where each setting comes from",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return PrintConfig(os.Stdout, cmd.Flags(), setts)
+		},
+	})
+
+	loginCmd := &cobra.Command{
+		Use:   "login",
+		Short: "Log into Write.as and store the access token for the subsequent runs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if setts.Login == "" || setts.Password == "" {
+				return fmt.Errorf("the login and the password must be specified")
+			}
+			_, token, err := passwordLogIn(setts)
 			if err != nil {
 				return err
 			}
-			return doSync(app.conv, app.ps, true, false)
+			err = NewTokenStore(setts.CredentialHelper).Store(setts.WriteAsEndpoint, setts.Login, token)
+			if err != nil {
+				return fmt.Errorf("failed to store the access token: %w", err)
+			}
+			slog.Default().Info("Logged in, the access token is stored", slog.String("login", setts.Login))
+			return nil
 		},
 	}
 
-	rootCmd.AddCommand(syncCmd, uploadCmd, downloadCmd)
+	logoutCmd := &cobra.Command{
+		Use:   "logout",
+		Short: "Revoke the stored access token",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store := NewTokenStore(setts.CredentialHelper)
+			token := setts.Token
+			if token == "" {
+				var err error
+				token, err = store.Get(setts.WriteAsEndpoint)
+				if err != nil {
+					return err
+				}
+			}
+			if token == "" {
+				return fmt.Errorf("not logged in")
+			}
+
+			writeAsClient := writeas.NewClientWith(writeas.Config{
+				URL: setts.WriteAsEndpoint,
+			})
+			writeAsClient.SetToken(token)
+			err := writeAsClient.LogOut()
+			if err != nil {
+				// The token is erased anyway, it's either revoked already or it will expire
+				slog.Default().Warn("Failed to revoke the access token", "error", err)
+			}
+
+			err = store.Erase(setts.WriteAsEndpoint)
+			if err != nil {
+				return fmt.Errorf("failed to erase the access token: %w", err)
+			}
+			slog.Default().Info("Logged out")
+			return nil
+		},
+	}
+
+	rootCmd.AddCommand(syncCmd, uploadCmd, downloadCmd, planCmd, gcCmd, configCmd, loginCmd, logoutCmd)
+
+	// The first Ctrl-C stops the synchronization after the current operation, the second one kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		slog.Default().Warn("Interrupted, stopping after the current operation (press Ctrl-C again to abort)")
+	}()
 
-	err := rootCmd.Execute()
+	err := rootCmd.ExecuteContext(ctx)
 	if err != nil {
 		slog.Default().Error("Command failed", "error", err)
 		os.Exit(1)